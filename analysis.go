@@ -0,0 +1,327 @@
+// analysis.go - analysis of a compiled WRR schedule
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+// Entropy returns the Shannon entropy, in bits, of the distribution
+// of slots over one cycle of the schedule. It is log2(n) for n
+// equally weighted slots and approaches 0 as one slot dominates.
+func (w *WRR[T]) Entropy() float64 {
+	t := w.tab.Load()
+	n := float64(t.size())
+
+	var h float64
+	for _, e := range t.eff {
+		if e > 0 {
+			p := float64(e) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// Autocorrelation returns the circular autocorrelation at 'lag' of
+// the indicator sequence of the slot at 'index' (in the original
+// input order) over one cycle of the schedule: 1 at the period of a
+// repeating pattern, negative when the slot tends to be followed by
+// others after 'lag' steps. Clustering shows up as high values at
+// short lags. Returns 0 for a bad index or a slot at every position.
+func (w *WRR[T]) Autocorrelation(index, lag int) float64 {
+	t := w.tab.Load()
+	if index < 0 || index >= len(t.slots) {
+		return 0
+	}
+
+	sz := t.size()
+	m := float64(t.eff[index]) / float64(sz)
+	lag %= sz
+	if lag < 0 {
+		lag += sz
+	}
+
+	x := func(i int) float64 {
+		if t.at(uint64(i)) == index {
+			return 1 - m
+		}
+		return -m
+	}
+
+	var num, den float64
+	for i := range sz {
+		a := x(i)
+		num += a * x((i+lag)%sz)
+		den += a * a
+	}
+	if den == 0 {
+		return 0
+	}
+	return num / den
+}
+
+// HasStarvation reports whether some slot waits more than 'maxGap'
+// selections of other slots between two of its own selections
+// anywhere in the cycle, and if so the index of the first such slot
+// in the original input order.
+func (w *WRR[T]) HasStarvation(maxGap int) (bool, int) {
+	t := w.tab.Load()
+	for j, g := range t.maxGaps(len(t.slots)) {
+		if g > maxGap {
+			return true, w.ext(j)
+		}
+	}
+	return false, w.none()
+}
+
+// Signature returns a short deterministic fingerprint of one cycle of
+// the compiled schedule, suitable as a golden value in regression
+// tests: it is the hex encoded FNV-1a 64-bit hash of the slot
+// indices of the cycle. Weight sets that compile to the same
+// schedule, e.g., proportional ones, have the same signature.
+func (w *WRR[T]) Signature() string {
+	t := w.tab.Load()
+	h := fnv.New64a()
+
+	var b [4]byte
+	for i := range t.size() {
+		binary.LittleEndian.PutUint32(b[:], uint32(t.at(uint64(i))))
+		h.Write(b[:])
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// CommonPeriod returns the least common multiple of the cycle
+// lengths of w and 'other': two schedulers that start together are
+// both back at the start of their cycles after this many selections
+// each.
+func (w *WRR[T]) CommonPeriod(other *WRR[T]) int {
+	a, b := w.tab.Load().size(), other.tab.Load().size()
+	return a / gcd(a, b) * b
+}
+
+// Simulate returns the per-slot counts, in the original input order,
+// of the next 'n' selections that Next() would make from the current
+// cursor position. The live cursor and stats are untouched; unlike
+// WithStats() this previews a configuration rather than tracking
+// real traffic. It takes time proportional to at most one cycle
+// regardless of n. With WithSharding() it starts from the shared
+// cursor, which Next() doesn't move. Returns nil if n < 0.
+func (w *WRR[T]) Simulate(n int) []uint64 {
+	if n < 0 {
+		return nil
+	}
+
+	t := w.tab.Load()
+	c := w.next.Load()
+	sz := t.size()
+
+	v := make([]uint64, len(t.slots))
+	full := uint64(n / sz)
+	for j, e := range t.eff {
+		v[j] = full * uint64(e)
+	}
+	for i := range n % sz {
+		v[t.at(c+uint64(i))]++
+	}
+	return v
+}
+
+// UnseenAfter returns the indices, in the original input order, of
+// the slots that the next 'n' selections Next() would make from the
+// current cursor position would not select; e.g., to check the
+// coverage of a short batch. Slots of weight 0 are always unseen and
+// no other slot is once n reaches the cycle length. The cursor is not
+// moved; with WithSharding() it is the shared cursor, which Next()
+// doesn't move, that is read. Returns nil if every slot is seen.
+func (w *WRR[T]) UnseenAfter(n int) []int {
+	t := w.tab.Load()
+	c := w.next.Load()
+
+	seen := make([]bool, len(t.slots))
+	for i := range min(max(n, 0), t.size()) {
+		seen[t.at(c+uint64(i))] = true
+	}
+
+	var v []int
+	for j, ok := range seen {
+		if !ok {
+			v = append(v, w.ext(j))
+		}
+	}
+	return v
+}
+
+// MinSamplesToCoverAll returns the length of the shortest prefix of
+// the cycle, from its first position, in which every slot of positive
+// weight appears at least once; e.g., to size a test that must see
+// every slot. It is one past the first appearance of the slot that
+// appears last, usually the lightest. Unlike UnseenAfter() the
+// cursor isn't used.
+func (w *WRR[T]) MinSamplesToCoverAll() int {
+	t := w.tab.Load()
+
+	left := 0
+	for _, e := range t.eff {
+		if e > 0 {
+			left++
+		}
+	}
+
+	seen := make([]bool, len(t.slots))
+	for i := range t.size() {
+		if j := t.at(uint64(i)); !seen[j] {
+			seen[j] = true
+			if left--; left == 0 {
+				return i + 1
+			}
+		}
+	}
+
+	// every slot of positive weight is in the cycle
+	return t.size()
+}
+
+// MaxWindowImbalance returns the largest deviation, in selections,
+// between the number of times a slot is selected in a run of
+// 'window' consecutive selections and the number expected from its
+// weight, over every slot and every starting position of the cycle
+// (wrapping around). A smooth schedule stays within about 1.
+// Returns 0 if window <= 0. Takes time proportional to the cycle
+// length times the number of slots.
+func (w *WRR[T]) MaxWindowImbalance(window int) float64 {
+	if window <= 0 {
+		return 0
+	}
+
+	t := w.tab.Load()
+	sz := t.size()
+	n := len(t.slots)
+
+	want := make([]float64, n)
+	for j, e := range t.eff {
+		want[j] = float64(window) * float64(e) / float64(sz)
+	}
+
+	cnt := make([]int, n)
+	for i := range window {
+		cnt[t.at(uint64(i))]++
+	}
+
+	var worst float64
+	for i := range sz {
+		for j, c := range cnt {
+			worst = max(worst, math.Abs(float64(c)-want[j]))
+		}
+
+		// slide the window one position
+		cnt[t.at(uint64(i))]--
+		cnt[t.at(uint64(i+window))]++
+	}
+	return worst
+}
+
+// ConvergenceWindow returns the smallest window length L such that
+// every run of L or more consecutive selections, from any position of
+// the cycle, gives every slot a share within 'tolerance' of its
+// configured share; e.g., with a tolerance of 0.05 a slot of weight
+// 30% gets between 25% and 35% of any such run. The smoother the
+// schedule, the shorter the window. A full cycle is always exact, so
+// the result is at most the cycle length. Takes time proportional to
+// the square of the cycle length times the number of slots.
+func (w *WRR[T]) ConvergenceWindow(tolerance float64) int {
+	t := w.tab.Load()
+	sz := t.size()
+
+	l := sz
+	for l > 1 && t.maxShareError(l-1) <= tolerance {
+		l--
+	}
+	return l
+}
+
+// CompareConvergence returns the ConvergenceWindow() of w and of
+// 'other' for the same tolerance, e.g., to compare the apportionment
+// methods of two schedulers over the same weights: the one with the
+// shorter window converges to its configured shares faster.
+func (w *WRR[T]) CompareConvergence(other *WRR[T], tolerance float64) (int, int) {
+	return w.ConvergenceWindow(tolerance), other.ConvergenceWindow(tolerance)
+}
+
+// maxShareError returns the largest difference between the share of
+// a slot in a run of 'window' consecutive positions, over every
+// starting position of the cycle, and its share of the whole cycle.
+func (t *table[T]) maxShareError(window int) float64 {
+	sz := t.size()
+	n := len(t.slots)
+
+	cnt := make([]int, n)
+	for i := range window {
+		cnt[t.at(uint64(i))]++
+	}
+
+	var worst float64
+	for i := range sz {
+		for j, c := range cnt {
+			d := float64(c)/float64(window) - float64(t.eff[j])/float64(sz)
+			worst = max(worst, math.Abs(d))
+		}
+
+		// slide the window one position
+		cnt[t.at(uint64(i))]--
+		cnt[t.at(uint64(i+window))]++
+	}
+	return worst
+}
+
+// maxGaps returns, for each of the n slots, the largest number of
+// selections of other slots between two consecutive selections of
+// that slot, wrapping around the cycle. A slot that appears at
+// every position has a gap of 0.
+func (s *schedule) maxGaps(n int) []int {
+	sz := s.size()
+
+	// single big alloc to reduce gc pressure
+	blk := make([]int, 3*n)
+	gaps, first, last := blk[:n], blk[n:2*n], blk[2*n:]
+	for j := range first {
+		first[j] = -1
+	}
+
+	for i := range sz {
+		j := s.at(uint64(i))
+		if first[j] < 0 {
+			first[j] = i
+		} else if g := i - last[j] - 1; g > gaps[j] {
+			gaps[j] = g
+		}
+		last[j] = i
+	}
+
+	// close the cycle
+	for j := range gaps {
+		if first[j] < 0 {
+			continue
+		}
+		if g := first[j] + sz - last[j] - 1; g > gaps[j] {
+			gaps[j] = g
+		}
+	}
+	return gaps
+}
@@ -0,0 +1,256 @@
+// analysis_test.go - tests for schedule analysis
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestEntropy(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := mustNew([]wItem{wi("A", 3), wi("B", 3), wi("C", 3), wi("D", 3)})
+	h := w.Entropy()
+	assert(math.Abs(h-2) < 1e-9, "uniform: expected 2 bits, got %v", h)
+
+	w = mustNew([]wItem{wi("A", 97), wi("B", 1), wi("C", 1), wi("D", 1)})
+	d := w.Entropy()
+	assert(d > 0 && d < h/2, "dominant: expected well below %v, got %v", h, d)
+
+	w = mustNew([]wItem{wi("A", 5)})
+	assert(w.Entropy() == 0, "single slot: expected 0, got %v", w.Entropy())
+}
+
+func TestAutocorrelation(t *testing.T) {
+	assert := newAsserter(t)
+
+	// bursts of three with a period of 6
+	seq := []uint16{0, 0, 0, 1, 1, 1, 0, 0, 0, 1, 1, 1}
+	w, err := NewFromSequence([]string{"A", "B"}, seq)
+	assert(err == nil, "%v", err)
+
+	r := w.Autocorrelation(0, 6)
+	assert(math.Abs(r-1) < 1e-9, "lag 6: expected 1, got %v", r)
+
+	r = w.Autocorrelation(0, 3)
+	assert(math.Abs(r+1) < 1e-9, "lag 3: expected -1, got %v", r)
+
+	r = w.Autocorrelation(0, 1)
+	assert(r > 0.3, "lag 1: expected clustering, got %v", r)
+
+	// the smooth schedule for the same weights alternates
+	s := mustNew([]wItem{wi("A", 1), wi("B", 1)})
+	r = s.Autocorrelation(0, 1)
+	assert(math.Abs(r+1) < 1e-9, "smooth lag 1: expected -1, got %v", r)
+
+	assert(w.Autocorrelation(2, 1) == 0, "bad index: expected 0")
+	s = mustNew([]wItem{wi("A", 1)})
+	assert(s.Autocorrelation(0, 1) == 0, "single slot: expected 0")
+}
+
+func TestHasStarvation(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := mustNew([]wItem{wi("A", 100), wi("B", 1)})
+	bad, j := w.HasStarvation(50)
+	assert(bad && j == 1, "expected B to starve, got %v %d", bad, j)
+
+	// B waits for all 100 A's
+	bad, j = w.HasStarvation(100)
+	assert(!bad && j == -1, "expected no starvation, got %v %d", bad, j)
+
+	w = mustNew([]wItem{wi("A", 1), wi("B", 1), wi("C", 1)})
+	bad, _ = w.HasStarvation(2)
+	assert(!bad, "round-robin: expected no starvation")
+	bad, j = w.HasStarvation(1)
+	assert(bad && j == 0, "round-robin: expected A to starve at gap 1, got %v %d", bad, j)
+}
+
+func TestSignature(t *testing.T) {
+	assert := newAsserter(t)
+
+	a := mustNew([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)})
+	b := mustNew([]wItem{wi("x", 50), wi("y", 30), wi("z", 20)})
+	sa, sb := a.Signature(), b.Signature()
+	assert(len(sa) == 16, "expected 16 hex digits, got %q", sa)
+	assert(sa == sb, "proportional weights: %s != %s", sa, sb)
+
+	// moving the cursor doesn't change it
+	a.Next()
+	assert(a.Signature() == sa, "signature changed with the cursor")
+
+	c := mustNew([]wItem{wi("A", 5), wi("B", 2), wi("C", 3)})
+	assert(c.Signature() != sa, "different schedule, same signature %s", sa)
+
+	w, err := New([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)}, WithIndexType(Uint32))
+	assert(err == nil, "%v", err)
+	assert(w.Signature() == sa, "index width changed the signature")
+}
+
+func TestCommonPeriod(t *testing.T) {
+	assert := newAsserter(t)
+
+	a := mustNew([]wItem{wi("A", 3), wi("B", 1)})
+	b := mustNew([]wItem{wi("C", 5), wi("D", 1)})
+	p := a.CommonPeriod(b)
+	assert(p == 12, "4 and 6: expected 12, got %d", p)
+	assert(b.CommonPeriod(a) == 12, "not symmetric")
+	assert(a.CommonPeriod(a) == 4, "self: expected 4, got %d", a.CommonPeriod(a))
+
+	// both are back at their cycle start after 12
+	for i := 0; i < p; i++ {
+		a.Next()
+		b.Next()
+	}
+	_, _, pa := a.NextWithPosition()
+	_, _, pb := b.NextWithPosition()
+	assert(pa == 0 && pb == 0, "expected both at 0, got %d %d", pa, pb)
+}
+
+func TestSimulate(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{wi("A", 50), wi("B", 30), wi("C", 20)}, WithStats())
+	assert(err == nil, "%v", err)
+
+	// one cycle is the (reduced) weights
+	v := w.Simulate(10)
+	assert(v[0] == 5 && v[1] == 3 && v[2] == 2, "one cycle: expected {5,3,2}, got %v", v)
+
+	// from the current cursor, without moving it
+	for i := 0; i < 3; i++ {
+		w.Next()
+	}
+	v = w.Simulate(1003)
+	ref := mustNew([]wItem{wi("A", 50), wi("B", 30), wi("C", 20)})
+	for i := 0; i < 3; i++ {
+		ref.Next()
+	}
+	m := tally(ref, 1003)
+	assert(v[0] == uint64(m["A"]) && v[1] == uint64(m["B"]) && v[2] == uint64(m["C"]),
+		"expected %v, got %v", m, v)
+
+	assert(w.next.Load() == 3, "cursor moved to %d", w.next.Load())
+	s := w.Stats()
+	assert(s[0]+s[1]+s[2] == 3, "stats changed: %v", s)
+
+	assert(w.Simulate(-1) == nil, "expected nil for negative n")
+}
+
+func TestUnseenAfter(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)})
+
+	// A B C A A B A C B A
+	v := w.UnseenAfter(1)
+	assert(slices.Equal(v, []int{1, 2}), "after 1: expected [1 2], got %v", v)
+	v = w.UnseenAfter(2)
+	assert(slices.Equal(v, []int{2}), "after 2: expected [2], got %v", v)
+	v = w.UnseenAfter(10)
+	assert(v == nil, "full cycle: expected none, got %v", v)
+	v = w.UnseenAfter(0)
+	assert(slices.Equal(v, []int{0, 1, 2}), "after 0: expected all, got %v", v)
+
+	// from the current cursor, without moving it: A A B ...
+	w.NextN(3)
+	v = w.UnseenAfter(2)
+	assert(slices.Equal(v, []int{1, 2}), "from 3: expected [1 2], got %v", v)
+	assert(w.Position() == 3, "cursor moved to %d", w.Position())
+
+	// disabled slots are never seen
+	w = mustNew([]wItem{wi("A", 1), wi("B", 0)})
+	v = w.UnseenAfter(100)
+	assert(slices.Equal(v, []int{1}), "disabled: expected [1], got %v", v)
+}
+
+func TestMinSamplesToCoverAll(t *testing.T) {
+	assert := newAsserter(t)
+
+	// A B C A A B A C B A
+	w := mustNew([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)})
+	assert(w.MinSamplesToCoverAll() == 3, "expected 3, got %d", w.MinSamplesToCoverAll())
+
+	// the light slot sits in the middle of the cycle
+	w = mustNew([]wItem{wi("A", 100), wi("B", 1)})
+	seq := w.Repeat(1)
+	pos := slices.IndexFunc(seq, func(v wItem) bool { return v.name == "B" })
+	assert(pos == 50, "expected B at position 50, got %d", pos)
+	assert(w.MinSamplesToCoverAll() == pos+1, "expected %d, got %d", pos+1, w.MinSamplesToCoverAll())
+
+	// the cursor doesn't matter and disabled slots don't count
+	w = mustNew([]wItem{wi("A", 3), wi("B", 0), wi("C", 1)})
+	w.NextN(3)
+	assert(w.MinSamplesToCoverAll() == 3, "expected 3, got %d", w.MinSamplesToCoverAll())
+	assert(mustNew([]wItem{wi("A", 7)}).MinSamplesToCoverAll() == 1, "expected 1 for one slot")
+}
+
+func TestMaxWindowImbalance(t *testing.T) {
+	assert := newAsserter(t)
+
+	// A B A B: every window of 2 is balanced
+	s := mustNew([]wItem{wi("A", 1), wi("B", 1)})
+	d := s.MaxWindowImbalance(2)
+	assert(d == 0, "smooth {1,1}: expected 0, got %v", d)
+
+	// A A B B: a window of 2 can hold two A's
+	b, err := NewFromSequence([]string{"A", "B"}, []uint16{0, 0, 1, 1})
+	assert(err == nil, "%v", err)
+	d = b.MaxWindowImbalance(2)
+	assert(d == 1, "bursty {2,2}: expected 1, got %v", d)
+
+	// same weights, smooth vs bursty order
+	w := mustNew([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)})
+	seq := []uint16{0, 0, 0, 0, 0, 1, 1, 1, 2, 2}
+	b, err = NewFromSequence([]string{"A", "B", "C"}, seq)
+	assert(err == nil, "%v", err)
+	for _, win := range []int{3, 5} {
+		ds, db := w.MaxWindowImbalance(win), b.MaxWindowImbalance(win)
+		assert(ds <= 1, "smooth window %d: expected <= 1, got %v", win, ds)
+		assert(db > ds, "window %d: bursty %v not worse than smooth %v", win, db, ds)
+	}
+
+	// a full cycle is exact
+	assert(w.MaxWindowImbalance(10) < 1e-9, "full cycle: expected 0")
+	assert(w.MaxWindowImbalance(0) == 0, "window 0: expected 0")
+}
+
+func TestConvergenceWindow(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{wi("A", 5), wi("B", 3), wi("C", 2)}
+
+	smooth := mustNew(slots)
+
+	// the same weights with each slot's selections in one run
+	contig, err := NewFromSequence(slots, []uint16{0, 0, 0, 0, 0, 1, 1, 1, 2, 2})
+	assert(err == nil, "from seq: %v", err)
+
+	a, b := smooth.CompareConvergence(contig, 0.2)
+	assert(a == smooth.ConvergenceWindow(0.2), "compare: expected %d, got %d", smooth.ConvergenceWindow(0.2), a)
+	assert(a == 5, "smooth: expected 5, got %d", a)
+	assert(b == 8, "contiguous: expected 8, got %d", b)
+
+	// every longer window is within tolerance
+	tab := smooth.tab.Load()
+	for l := a; l <= 10; l++ {
+		e := tab.maxShareError(l)
+		assert(e <= 0.2, "window %d: share error %v", l, e)
+	}
+	assert(tab.maxShareError(a-1) > 0.2, "window %d also converges", a-1)
+
+	// exact shares take a whole cycle unless the cycle repeats
+	assert(smooth.ConvergenceWindow(0) == 10, "expected 10, got %d", smooth.ConvergenceWindow(0))
+	u := mustNew([]wItem{wi("A", 1), wi("B", 1)})
+	assert(u.ConvergenceWindow(0.5) == 1, "expected 1, got %d", u.ConvergenceWindow(0.5))
+}
@@ -0,0 +1,51 @@
+// chain.go - tiered failover across WRR schedulers
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+// Chain is an ordered list of independently weighted schedulers,
+// e.g., primary, secondary and tertiary pools; a selection falls
+// through to the next tier only when no slot of the current tier is
+// ready. Safe for concurrent use.
+type Chain[T any] struct {
+	tiers []*WRR[T]
+}
+
+// NewChain makes a failover chain over 'tiers', highest priority
+// first. The slice is copied; the schedulers are shared.
+func NewChain[T any](tiers []*WRR[T]) *Chain[T] {
+	c := &Chain[T]{
+		tiers: make([]*WRR[T], len(tiers)),
+	}
+	copy(c.tiers, tiers)
+	return c
+}
+
+// Next returns the next ready item of the first tier that has one:
+// within a tier, the cursor advances past unready slots as in
+// NextAllowed(), scanning at most one cycle of the tier. Returns
+// false if no slot in any tier is ready.
+func (c *Chain[T]) Next(ready func(T) bool) (T, bool) {
+	var z T
+
+	for _, w := range c.tiers {
+		t, j, ok := w.nextWhere(func(t *table[T], j int) bool {
+			return ready(t.slots[j])
+		})
+		if ok {
+			return t.slots[j], true
+		}
+	}
+	return z, false
+}
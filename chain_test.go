@@ -0,0 +1,56 @@
+// chain_test.go - tests for tiered failover
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"testing"
+)
+
+func TestChain(t *testing.T) {
+	assert := newAsserter(t)
+	primary := mustNew([]wItem{wi("p1", 3), wi("p2", 1)})
+	secondary := mustNew([]wItem{wi("s1", 1), wi("s2", 1)})
+	c := NewChain([]*WRR[wItem]{primary, secondary})
+
+	down := make(map[string]bool)
+	ready := func(v wItem) bool { return !down[v.name] }
+
+	// healthy primary: only primary is used, by weight
+	m := make(map[string]int)
+	for i := 0; i < 400; i++ {
+		v, ok := c.Next(ready)
+		assert(ok, "expected a ready item")
+		m[v.name]++
+	}
+	assert(m["p1"] == 300 && m["p2"] == 100, "primary: expected 300:100, got %v", m)
+
+	// partially down primary still serves
+	down["p1"] = true
+	v, ok := c.Next(ready)
+	assert(ok && v.name == "p2", "expected p2, got %s", v.name)
+
+	// primary all down: secondary takes over
+	down["p2"] = true
+	m = make(map[string]int)
+	for i := 0; i < 100; i++ {
+		v, ok := c.Next(ready)
+		assert(ok, "expected a ready item")
+		m[v.name]++
+	}
+	assert(m["s1"] == 50 && m["s2"] == 50, "secondary: expected 50:50, got %v", m)
+
+	down["s1"], down["s2"] = true, true
+	_, ok = c.Next(ready)
+	assert(!ok, "expected nothing ready")
+}
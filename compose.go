@@ -0,0 +1,80 @@
+// compose.go - building longer sequences from WRR schedules
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+)
+
+// Repeat returns 'n' full cycles of the schedule concatenated, each
+// starting from the first position of the cycle. The cursor is not
+// used or moved and nothing is counted. Returns nil if n <= 0.
+func (w *WRR[T]) Repeat(n int) []T {
+	if n <= 0 {
+		return nil
+	}
+
+	t := w.tab.Load()
+	sz := t.size()
+	v := make([]T, 0, n*sz)
+	for range n {
+		v = t.appendCycle(v)
+	}
+	return v
+}
+
+// Concat returns one full cycle of w followed by one full cycle of
+// 'other', each starting from the first position of its cycle.
+// Neither cursor is used or moved and nothing is counted.
+func (w *WRR[T]) Concat(other *WRR[T]) []T {
+	a, b := w.tab.Load(), other.tab.Load()
+	v := make([]T, 0, a.size()+b.size())
+	v = a.appendCycle(v)
+	return b.appendCycle(v)
+}
+
+// appendCycle appends one cycle of the items of t to v
+func (t *table[T]) appendCycle(v []T) []T {
+	for i := range t.size() {
+		v = append(v, t.slots[t.at(uint64(i))])
+	}
+	return v
+}
+
+// Flatten constructs a single scheduler over the slots of all the
+// 'children', in order, each with its effective weight in its child
+// (including any WithMinRate() floor). A child's slots thus weigh its
+// cycle length in total, TotalWeight(). This collapses a two level
+// hierarchy, where a parent picks a child weighted by its cycle
+// length and the child picks one of its slots, into one table: every
+// slot gets the same global share as in the hierarchy, exactly, once
+// per cycle.
+//
+// The children are not modified; later changes to them are not
+// reflected.
+func Flatten[T any](children []*WRR[T], opts ...Option) (*WRR[T], error) {
+	if len(children) == 0 {
+		return nil, fmt.Errorf("wrr: no schedulers to flatten")
+	}
+
+	var slots []T
+	var wts []int
+	for _, c := range children {
+		t := c.tab.Load()
+		slots = append(slots, t.slots...)
+		wts = append(wts, t.eff...)
+	}
+	return build(slots, wts, opts)
+}
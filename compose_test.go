@@ -0,0 +1,122 @@
+// compose_test.go - tests for sequence composition
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"testing"
+)
+
+func names(v []wItem) string {
+	var s string
+	for _, x := range v {
+		s += x.name
+	}
+	return s
+}
+
+func TestRepeat(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 3),
+		wi("B", 1),
+	})
+
+	w.Next()
+
+	// {3,1} -> AABA, from the start of the cycle
+	v := w.Repeat(3)
+	assert(len(v) == 12, "expected 12 items, got %d", len(v))
+	assert(names(v) == "AABAAABAAABA", "unexpected sequence %s", names(v))
+
+	assert(w.Repeat(0) == nil, "expected nil for 0 cycles")
+
+	// cursor is untouched
+	x := w.Next()
+	assert(x.name == "A", "cursor moved: expected A, got %s", x.name)
+}
+
+func TestConcat(t *testing.T) {
+	assert := newAsserter(t)
+	a := mustNew([]wItem{
+		wi("A", 3),
+		wi("B", 1),
+	})
+	b := mustNew([]wItem{
+		wi("C", 1),
+		wi("D", 2),
+	})
+
+	v := a.Concat(b)
+	assert(len(v) == 7, "expected 7 items, got %d", len(v))
+	assert(names(v) == "AABADCD", "unexpected sequence %s", names(v))
+
+	v = b.Concat(b)
+	assert(names(v) == "DCDDCD", "unexpected sequence %s", names(v))
+}
+
+// group is a child scheduler weighted by its cycle length
+type group struct {
+	w *WRR[wItem]
+}
+
+func (g group) Weight() int {
+	return g.w.TotalWeight()
+}
+
+func TestFlatten(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		a, b []wItem
+		seq  string
+	}{
+		{
+			[]wItem{wi("A", 3), wi("B", 1)},
+			[]wItem{wi("C", 2), wi("D", 4), wi("E", 2)},
+			"ADBACEDA",
+		},
+		// the children reduce by different gcds
+		{
+			[]wItem{wi("A", 30), wi("B", 10)},
+			[]wItem{wi("C", 1), wi("D", 2), wi("E", 1)},
+			"ADBACEDA",
+		},
+	}
+
+	for i := range tests {
+		tc := &tests[i]
+		a, b := mustNew(tc.a), mustNew(tc.b)
+
+		f, err := Flatten([]*WRR[wItem]{a, b})
+		assert(err == nil, "%d: flatten: %v", i, err)
+		assert(f.Len() == 5, "%d: expected 5 slots, got %d", i, f.Len())
+		assert(names(f.Repeat(1)) == tc.seq, "%d: expected %s, got %s", i, tc.seq, names(f.Repeat(1)))
+
+		// the hierarchy: a parent over the children
+		p := mustNew([]group{{a}, {b}})
+
+		n := f.TotalWeight() * p.TotalWeight() * a.TotalWeight() * b.TotalWeight()
+		flat := tally(f, n)
+		tree := make(map[string]int)
+		for range n {
+			tree[p.Next().w.Next().name]++
+		}
+		for k, v := range tree {
+			assert(flat[k] == v, "%d: %s: hierarchy %d, flat %d", i, k, v, flat[k])
+		}
+	}
+
+	_, err := Flatten[wItem](nil)
+	assert(err != nil, "expected error for no children")
+}
@@ -0,0 +1,68 @@
+// cursor.go - cursor management for WRR
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"sync/atomic"
+)
+
+// Returns the next item in the smooth weighted sequence for the
+// independent cursor 'cursorID'. Each cursor walks the same shared
+// schedule at its own phase; this is cheaper than cloning the
+// scheduler for subsystems that need their own phase. Cursors are
+// created on first use and start at the beginning of the cycle.
+// They are independent of the cursor used by Next().
+//
+// 'cursorID' must be non-negative; ids should be small and dense
+// since storage grows with the largest id used.
+func (w *WRR[T]) NextFor(cursorID int) T {
+	c := w.cursor(cursorID)
+	t := w.tab.Load()
+	v := c.Add(1) - 1
+	if v >= wrapAt {
+		rewind(c, t.size())
+	}
+	j := t.at(v)
+	t.count(j)
+	return t.slots[j]
+}
+
+// cursor returns the counter for the given cursor id, creating it
+// if needed.
+func (w *WRR[T]) cursor(id int) *atomic.Uint64 {
+	if p := w.cursors.Load(); p != nil && id < len(*p) {
+		return (*p)[id]
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var cur []*atomic.Uint64
+	if p := w.cursors.Load(); p != nil {
+		if id < len(*p) {
+			return (*p)[id]
+		}
+		cur = *p
+	}
+
+	// copy on write so readers never see a partial slice
+	nc := make([]*atomic.Uint64, id+1)
+	copy(nc, cur)
+	for i := len(cur); i < len(nc); i++ {
+		nc[i] = &atomic.Uint64{}
+	}
+	w.cursors.Store(&nc)
+	return nc[id]
+}
@@ -0,0 +1,54 @@
+// cursor_test.go - tests for cursor management
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"testing"
+)
+
+func TestNextForIndependentCursors(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w := mustNew(slots)
+	ref := mustNew(slots)
+	want := make([]string, 25)
+	for i := range want {
+		want[i] = ref.Next().name
+	}
+
+	// advance cursor 3 ahead of cursor 0 and the default cursor
+	for i := 0; i < 7; i++ {
+		v := w.NextFor(3)
+		assert(v.name == want[i], "cursor 3 step %d: expected %s, got %s", i, want[i], v.name)
+	}
+
+	for i := 0; i < 10; i++ {
+		v := w.NextFor(0)
+		assert(v.name == want[i], "cursor 0 step %d: expected %s, got %s", i, want[i], v.name)
+	}
+
+	for i := 7; i < 25; i++ {
+		v := w.NextFor(3)
+		assert(v.name == want[i], "cursor 3 step %d: expected %s, got %s", i, want[i], v.name)
+	}
+
+	// the default cursor hasn't moved
+	v := w.Next()
+	assert(v.name == want[0], "default cursor: expected %s, got %s", want[0], v.name)
+}
@@ -0,0 +1,143 @@
+// dwrr.go - cost aware deficit weighted round robin
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// DWRR is a deficit weighted round-robin scheduler: each selection
+// carries a cost, e.g., the size of a job, and the items absorb total
+// cost in proportion to their weights rather than a proportional
+// number of selections. Each item in turn receives its weight as a
+// quantum of credit (its deficit) and is selected while the deficit
+// covers the cost of the selection; the cost is then charged to it.
+// Unused credit carries over to the item's next turn. Safe for
+// concurrent use.
+//
+// The weights are the quanta: they should be comparable to or larger
+// than typical costs, else a selection may have to go around several
+// times before any deficit covers it.
+type DWRR[T any] struct {
+	sync.Mutex
+
+	slots []T
+	wts   []int
+	def   []int // deficit of each slot
+	cur   int   // slot whose turn it is
+}
+
+// Constructs a new deficit round-robin scheduler from the given
+// slots; the `Weight()` of each slot is its quantum. Slots of weight
+// 0 are never selected; negative weights, or no slot of positive
+// weight, are an error.
+//
+// The input slice is not retained or modified.
+func NewDWRR[T Weighted](slots []T) (*DWRR[T], error) {
+	n := len(slots)
+	if n == 0 {
+		return nil, fmt.Errorf("wrr: no slots to weight")
+	}
+
+	tot := 0
+
+	// single big alloc to reduce gc pressure
+	blk := make([]int, 2*n)
+	wts, def := blk[:n], blk[n:]
+	for i := range slots {
+		w := slots[i].Weight()
+		if w < 0 {
+			return nil, fmt.Errorf("wrr: slot index %d: bad weight %d", i, w)
+		}
+		if tot > math.MaxInt-w {
+			return nil, fmt.Errorf("wrr: slot index %d: total weight overflow", i)
+		}
+		wts[i] = w
+		tot += w
+	}
+	if tot == 0 {
+		return nil, fmt.Errorf("wrr: no slot has a positive weight")
+	}
+
+	d := &DWRR[T]{
+		slots: make([]T, n),
+		wts:   wts,
+		def:   def,
+	}
+
+	// the first slot starts its turn
+	d.def[0] = wts[0]
+	copy(d.slots, slots)
+	return d, nil
+}
+
+// Returns the next item for a selection of unit cost; this is
+// NextCost(1).
+func (d *DWRR[T]) Next() T {
+	return d.NextCost(1)
+}
+
+// Returns the next item to take a selection of the given cost,
+// charging the cost to its deficit. The item whose turn it is is
+// selected if its deficit covers the cost; otherwise the turn passes
+// to the next item, which receives its quantum, and so on. Costs
+// below 1 count as 1.
+func (d *DWRR[T]) NextCost(cost int) T {
+	cost = max(cost, 1)
+
+	d.Lock()
+	defer d.Unlock()
+
+	// skip whole rounds in which no deficit can cover the cost
+	if d.def[d.cur] < cost {
+		if k := d.rounds(cost); k > 1 {
+			for i := range d.def {
+				d.def[i] += (k - 1) * d.wts[i]
+			}
+		}
+	}
+
+	n := len(d.slots)
+	for d.def[d.cur] < cost {
+		d.cur = (d.cur + 1) % n
+		d.def[d.cur] += d.wts[d.cur]
+	}
+
+	d.def[d.cur] -= cost
+	return d.slots[d.cur]
+}
+
+// rounds returns the number of quanta the slot that can first cover
+// 'cost' still needs; at most math.MaxInt/2 to avoid overflow.
+func (d *DWRR[T]) rounds(cost int) int {
+	k := math.MaxInt / 2
+	for i, w := range d.wts {
+		if w > 0 {
+			k = min(k, (cost-d.def[i]+w-1)/w)
+		}
+	}
+	return k
+}
+
+// Deficits returns a snapshot of the deficit of each slot in the
+// original input order.
+func (d *DWRR[T]) Deficits() []int {
+	d.Lock()
+	defer d.Unlock()
+
+	return append([]int(nil), d.def...)
+}
@@ -0,0 +1,86 @@
+// dwrr_test.go - tests for the deficit round-robin scheduler
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestDWRRCost(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 300),
+		wi("B", 100),
+		wi("C", 0),
+		wi("D", 200),
+	}
+
+	d, err := NewDWRR(slots)
+	assert(err == nil, "new: %v", err)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	cost := make(map[string]int)
+	picks := make(map[string]int)
+	var tot int
+	for range 100000 {
+		// a few expensive jobs among many cheap ones
+		c := 1 + rng.IntN(10)
+		if rng.IntN(10) == 0 {
+			c *= 50
+		}
+
+		v := d.NextCost(c)
+		cost[v.name] += c
+		picks[v.name]++
+		tot += c
+	}
+
+	assert(cost["C"] == 0, "disabled slot C selected %d times", picks["C"])
+	for _, s := range slots {
+		want := float64(tot) * float64(s.w) / 600
+		e := math.Abs(float64(cost[s.name])-want) / float64(tot)
+		assert(e < 0.01, "%s: cost %d, expected %.0f", s.name, cost[s.name], want)
+	}
+
+	// the deficits never exceed a quantum plus the largest cost
+	for i, v := range d.Deficits() {
+		assert(v >= 0 && v < slots[i].w+500, "slot %d: deficit %d", i, v)
+	}
+}
+
+func TestDWRRUnitCost(t *testing.T) {
+	assert := newAsserter(t)
+	d, err := NewDWRR([]wItem{wi("A", 3), wi("B", 1)})
+	assert(err == nil, "new: %v", err)
+
+	// unit costs are plain (unsmoothed) weighted round-robin
+	var s string
+	for range 8 {
+		s += d.Next().name
+	}
+	assert(s == "AAABAAAB", "expected AAABAAAB, got %s", s)
+
+	// a cost above every quantum skips whole rounds
+	v := d.NextCost(1000)
+	assert(v.name == "A", "expected A, got %s", v.name)
+
+	_, err = NewDWRR([]wItem{wi("A", 0)})
+	assert(err != nil, "expected error for all zero weights")
+	_, err = NewDWRR([]wItem{wi("A", -1)})
+	assert(err != nil, "expected error for negative weight")
+	_, err = NewDWRR[wItem](nil)
+	assert(err != nil, "expected error for no slots")
+}
@@ -0,0 +1,333 @@
+// marshal.go - binary serialization of a compiled WRR table
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync/atomic"
+)
+
+// tableMagic identifies version 1 of the binary table format:
+//
+//	magic   [4]byte "WRR\x01"
+//	n       uvarint number of slots
+//	n times:
+//	  weight  uvarint configured weight
+//	  eff     uvarint effective weight
+//	  len     uvarint length of the encoded item
+//	  item    [len]byte
+//	size    uvarint entries in the table
+//	width   byte    1, 2 or 4
+//	entries [size]uint{8,16,32} little endian slot indices
+//
+// Version 2, statsMagic "WRR\x02", is the same followed by the
+// selection counts:
+//
+//	n times:
+//	  count   uvarint selections of the slot
+const (
+	tableMagic = "WRR\x01"
+	statsMagic = "WRR\x02"
+)
+
+// MarshalBinary implements encoding.BinaryMarshaler for items that
+// implement it themselves; see MarshalBinaryWith().
+func (w *WRR[T]) MarshalBinary() ([]byte, error) {
+	return w.MarshalBinaryWith(func(v T) ([]byte, error) {
+		m, ok := any(v).(encoding.BinaryMarshaler)
+		if !ok {
+			return nil, fmt.Errorf("wrr: %T is not a BinaryMarshaler", v)
+		}
+		return m.MarshalBinary()
+	})
+}
+
+// MarshalBinaryWith serializes the compiled table: the items, each
+// encoded with 'enc', their weights and the compiled sequence. A
+// scheduler restored with UnmarshalBinaryWith() selects the same
+// sequence without compiling it again. The cursor, stats and options
+// are not included; see MarshalBinaryWithStats().
+func (w *WRR[T]) MarshalBinaryWith(enc func(T) ([]byte, error)) ([]byte, error) {
+	return w.tab.Load().marshal([]byte(tableMagic), enc)
+}
+
+// MarshalBinaryWithStats is MarshalBinaryWith() followed by the
+// per-slot selection counts, so a restarted process can resume its
+// cumulative stats; UnmarshalBinaryWith() restores them. This is
+// opt-in as it adds a varint per slot to the payload. Returns an
+// error unless the scheduler was constructed with WithStats().
+func (w *WRR[T]) MarshalBinaryWithStats(enc func(T) ([]byte, error)) ([]byte, error) {
+	t := w.tab.Load()
+	if t.stats == nil {
+		return nil, errors.New("wrr: stats not enabled")
+	}
+
+	b, err := t.marshal([]byte(statsMagic), enc)
+	if err != nil {
+		return nil, err
+	}
+	for i := range t.stats {
+		b = binary.AppendUvarint(b, t.stats[i].Load())
+	}
+	return b, nil
+}
+
+// marshal appends the table, encoding each item with 'enc', to the
+// header in b
+func (t *table[T]) marshal(b []byte, enc func(T) ([]byte, error)) ([]byte, error) {
+	b = binary.AppendUvarint(b, uint64(len(t.slots)))
+	for i := range t.slots {
+		v, err := enc(t.slots[i])
+		if err != nil {
+			return nil, fmt.Errorf("wrr: slot index %d: %w", i, err)
+		}
+
+		b = binary.AppendUvarint(b, uint64(t.wts[i]))
+		b = binary.AppendUvarint(b, uint64(t.eff[i]))
+		b = binary.AppendUvarint(b, uint64(len(v)))
+		b = append(b, v...)
+	}
+
+	b = binary.AppendUvarint(b, uint64(t.size()))
+	switch {
+	case t.narrow != nil:
+		b = append(b, 1)
+		b = append(b, t.narrow...)
+	case t.wide != nil:
+		b = append(b, 4)
+		for _, j := range t.wide {
+			b = binary.LittleEndian.AppendUint32(b, j)
+		}
+	default:
+		b = append(b, 2)
+		for _, j := range t.seq {
+			b = binary.LittleEndian.AppendUint16(b, j)
+		}
+	}
+	return b, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler for items
+// whose pointer implements it; see UnmarshalBinaryWith().
+func (w *WRR[T]) UnmarshalBinary(b []byte) error {
+	return w.UnmarshalBinaryWith(b, func(p []byte) (T, error) {
+		var v T
+
+		u, ok := any(&v).(encoding.BinaryUnmarshaler)
+		if !ok {
+			return v, fmt.Errorf("wrr: %T is not a BinaryUnmarshaler", &v)
+		}
+		err := u.UnmarshalBinary(p)
+		return v, err
+	})
+}
+
+// UnmarshalBinaryWith restores a table serialized by
+// MarshalBinaryWith() or MarshalBinaryWithStats(), decoding each item
+// with 'dec'. The table is validated but not recompiled. It may be
+// restored into a zero WRR or replace the table of an existing
+// scheduler, which keeps its options: with WithStats() the counts are
+// restored if they were serialized and start at zero otherwise;
+// without it serialized counts are ignored. Either way the cursor
+// starts at the beginning of the cycle and any pending weight change
+// is cancelled. As the restored slots need not be the old ones, the
+// state an existing scheduler keeps by slot index is dropped: the
+// History(), sessions pinned by PickSession(), the last NextNoRepeat()
+// pick and LinkAntiAffinity() links to or from it. On error the
+// scheduler is unchanged.
+func (w *WRR[T]) UnmarshalBinaryWith(b []byte, dec func([]byte) (T, error)) error {
+	nt, counts, err := decodeTable(b, dec)
+	if err != nil {
+		return fmt.Errorf("wrr: unmarshal: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.opt.stats {
+		nt.stats = make([]atomic.Uint64, len(nt.slots))
+		for i, v := range counts {
+			nt.stats[i].Store(v)
+		}
+	}
+	if t := w.tab.Load(); t != nil {
+		// the restored slots need not be the old ones
+		drop := func(int64) int64 { return -1 }
+		if t.hist != nil {
+			nt.hist = t.hist.remap(drop)
+		}
+		w.renumber(drop)
+		nt.epoch = t.epoch + 1
+	} else if w.opt.history > 0 {
+		nt.hist = &history{
+			buf: make([]atomic.Int64, w.opt.history),
+		}
+	}
+
+	w.pending.Store(nil)
+	w.tab.Store(nt)
+	w.next.Store(0)
+	return nil
+}
+
+var errShort = errors.New("truncated table")
+
+// decodeTable decodes and validates a table in the format described
+// by tableMagic, along with the counts if it has them.
+func decodeTable[T any](b []byte, dec func([]byte) (T, error)) (*table[T], []uint64, error) {
+	if len(b) < len(tableMagic) {
+		return nil, nil, errors.New("bad table header")
+	}
+
+	var withStats bool
+	switch string(b[:len(tableMagic)]) {
+	case tableMagic:
+	case statsMagic:
+		withStats = true
+	default:
+		return nil, nil, errors.New("bad table header")
+	}
+	b = b[len(tableMagic):]
+
+	uvarint := func() (int, error) {
+		v, k := binary.Uvarint(b)
+		if k <= 0 {
+			return 0, errShort
+		}
+		if v > math.MaxInt {
+			return 0, fmt.Errorf("value %d out of range", v)
+		}
+		b = b[k:]
+		return int(v), nil
+	}
+
+	n, err := uvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// every slot takes at least 3 bytes
+	if n == 0 || n > len(b)/3 {
+		return nil, nil, fmt.Errorf("bad slot count %d", n)
+	}
+
+	t := &table[T]{
+		slots: make([]T, n),
+		wts:   make([]int, n),
+	}
+	t.eff = make([]int, n)
+	for i := range n {
+		if t.wts[i], err = uvarint(); err != nil {
+			return nil, nil, err
+		}
+		if t.eff[i], err = uvarint(); err != nil {
+			return nil, nil, err
+		}
+
+		k, err := uvarint()
+		if err != nil {
+			return nil, nil, err
+		}
+		if k > len(b) {
+			return nil, nil, errShort
+		}
+		if t.slots[i], err = dec(b[:k]); err != nil {
+			return nil, nil, fmt.Errorf("slot index %d: %w", i, err)
+		}
+		b = b[k:]
+	}
+
+	size, err := uvarint()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(b) < 1 {
+		return nil, nil, errShort
+	}
+	width := int(b[0])
+	b = b[1:]
+	if width != 1 && width != 2 && width != 4 {
+		return nil, nil, fmt.Errorf("bad index width %d", width)
+	}
+	if size == 0 || size > len(b)/width {
+		return nil, nil, fmt.Errorf("bad table size %d", size)
+	}
+
+	seen := make([]int, n)
+	check := func(j int) error {
+		if j >= n {
+			return fmt.Errorf("bad slot %d (%d slots)", j, n)
+		}
+		seen[j]++
+		return nil
+	}
+
+	switch width {
+	case 1:
+		t.narrow = make([]uint8, size)
+		for i := range t.narrow {
+			t.narrow[i] = b[i]
+			if err := check(int(t.narrow[i])); err != nil {
+				return nil, nil, err
+			}
+		}
+	case 4:
+		t.wide = make([]uint32, size)
+		for i := range t.wide {
+			t.wide[i] = binary.LittleEndian.Uint32(b[4*i:])
+			if err := check(int(t.wide[i])); err != nil {
+				return nil, nil, err
+			}
+		}
+	default:
+		t.seq = make([]uint16, size)
+		for i := range t.seq {
+			t.seq[i] = binary.LittleEndian.Uint16(b[2*i:])
+			if err := check(int(t.seq[i])); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	for j, e := range t.eff {
+		if seen[j] != e {
+			return nil, nil, fmt.Errorf("slot index %d: %d entries for effective weight %d", j, seen[j], e)
+		}
+	}
+	b = b[size*width:]
+
+	var counts []uint64
+	if withStats {
+		counts = make([]uint64, n)
+		for i := range counts {
+			v, k := binary.Uvarint(b)
+			if k <= 0 {
+				return nil, nil, errShort
+			}
+			counts[i] = v
+			b = b[k:]
+		}
+	}
+	if len(b) != 0 {
+		return nil, nil, fmt.Errorf("%d trailing bytes", len(b))
+	}
+
+	t.cdf = cumulative(t.eff)
+	return t, counts, nil
+}
@@ -0,0 +1,213 @@
+// marshal_test.go - tests for binary serialization
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+// bItem is a wItem that marshals itself
+type bItem struct {
+	wItem
+}
+
+func (b bItem) MarshalBinary() ([]byte, error) {
+	v := binary.AppendUvarint(nil, uint64(b.w))
+	return append(v, b.name...), nil
+}
+
+func (b *bItem) UnmarshalBinary(p []byte) error {
+	v, k := binary.Uvarint(p)
+	if k <= 0 {
+		return fmt.Errorf("bad item")
+	}
+	b.w, b.name = int(v), string(p[k:])
+	return nil
+}
+
+func TestMarshalBinary(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []bItem{
+		{wi("A", 5)},
+		{wi("B", 3)},
+		{wi("C", 0)},
+		{wi("D", 2)},
+	}
+
+	w, err := New(slots)
+	assert(err == nil, "new: %v", err)
+	w.NextN(7)
+
+	b, err := w.MarshalBinary()
+	assert(err == nil, "marshal: %v", err)
+
+	var r WRR[bItem]
+	err = r.UnmarshalBinary(b)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(slices.Equal(r.Weights(), w.Weights()), "weights: expected %v, got %v", w.Weights(), r.Weights())
+
+	// the restored scheduler starts at the beginning of the cycle
+	for i, x := range w.Repeat(3) {
+		v := r.Next()
+		assert(v == x, "step %d: expected %v, got %v", i, x, v)
+	}
+
+	// items that don't marshal themselves
+	_, err = mustNew([]wItem{wi("A", 1)}).MarshalBinary()
+	assert(err != nil, "expected error for items that don't marshal")
+}
+
+func TestMarshalBinaryWith(t *testing.T) {
+	assert := newAsserter(t)
+	enc := func(v wItem) ([]byte, error) { return []byte(v.name), nil }
+	dec := func(p []byte) (wItem, error) { return wItem{name: string(p)}, nil }
+
+	for _, opt := range []Option{WithIndexType(Uint16), WithIndexType(Uint32)} {
+		w, err := New([]wItem{
+			wi("A", 997),
+			wi("B", 991),
+			wi("C", 7),
+		}, opt)
+		assert(err == nil, "new: %v", err)
+
+		b, err := w.MarshalBinaryWith(enc)
+		assert(err == nil, "marshal: %v", err)
+
+		// restore into a scheduler with its own options
+		r, err := New([]wItem{wi("X", 1)}, WithStats())
+		assert(err == nil, "new: %v", err)
+		err = r.UnmarshalBinaryWith(b, dec)
+		assert(err == nil, "unmarshal: %v", err)
+		assert(r.Len() == 3, "expected 3 slots, got %d", r.Len())
+		assert(slices.Equal(r.Stats(), []uint64{0, 0, 0}), "expected zero stats, got %v", r.Stats())
+
+		x, y := w.tab.Load(), r.tab.Load()
+		assert(x.size() == y.size(), "expected %d entries, got %d", x.size(), y.size())
+		for i := range x.size() {
+			p, q := x.at(uint64(i)), y.at(uint64(i))
+			assert(p == q, "pos %d: expected %d, got %d", i, p, q)
+		}
+
+		// corrupt tables are rejected and leave r unchanged
+		for _, c := range [][]byte{
+			nil,
+			b[:len(b)-1],
+			append(slices.Clone(b), 0),
+			[]byte("WRR\x02"),
+		} {
+			err = r.UnmarshalBinaryWith(c, dec)
+			assert(err != nil, "expected error for corrupt table of %d bytes", len(c))
+		}
+		assert(r.tab.Load() == y, "failed unmarshal changed the table")
+	}
+
+	// an entry naming a slot out of range
+	w := mustNew([]wItem{wi("A", 1), wi("B", 1)})
+	b, err := w.MarshalBinaryWith(enc)
+	assert(err == nil, "marshal: %v", err)
+	b[len(b)-2] = 2
+	var r WRR[wItem]
+	err = r.UnmarshalBinaryWith(b, dec)
+	assert(err != nil, "expected error for bad slot")
+}
+
+func TestMarshalBinaryWithStats(t *testing.T) {
+	assert := newAsserter(t)
+	enc := func(v wItem) ([]byte, error) { return []byte(v.name), nil }
+	dec := func(p []byte) (wItem, error) { return wItem{name: string(p)}, nil }
+
+	w, err := New([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}, WithStats())
+	assert(err == nil, "new: %v", err)
+	w.NextN(1234)
+
+	b, err := w.MarshalBinaryWithStats(enc)
+	assert(err == nil, "marshal: %v", err)
+
+	r, err := New([]wItem{wi("X", 1)}, WithStats())
+	assert(err == nil, "new: %v", err)
+	err = r.UnmarshalBinaryWith(b, dec)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(slices.Equal(r.Stats(), w.Stats()), "stats: expected %v, got %v", w.Stats(), r.Stats())
+
+	// counting resumes from the restored values: one more cycle
+	r.NextN(10)
+	v := w.Stats()
+	v[0], v[1], v[2] = v[0]+5, v[1]+3, v[2]+2
+	assert(slices.Equal(r.Stats(), v), "stats: expected %v, got %v", v, r.Stats())
+
+	// without WithStats() the counts are ignored
+	var z WRR[wItem]
+	err = z.UnmarshalBinaryWith(b, dec)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(z.Stats() == nil, "expected no stats, got %v", z.Stats())
+
+	// a table without counts restores zero counts
+	b, err = w.MarshalBinaryWith(enc)
+	assert(err == nil, "marshal: %v", err)
+	err = r.UnmarshalBinaryWith(b, dec)
+	assert(err == nil, "unmarshal: %v", err)
+	assert(slices.Equal(r.Stats(), []uint64{0, 0, 0}), "expected zero stats, got %v", r.Stats())
+
+	// truncated counts are rejected
+	b, err = w.MarshalBinaryWithStats(enc)
+	assert(err == nil, "marshal: %v", err)
+	err = r.UnmarshalBinaryWith(b[:len(b)-1], dec)
+	assert(err != nil, "expected error for truncated counts")
+
+	_, err = mustNew([]wItem{wi("A", 1)}).MarshalBinaryWithStats(enc)
+	assert(err != nil, "expected error without stats")
+}
+
+func TestUnmarshalDropsSlotState(t *testing.T) {
+	assert := newAsserter(t)
+	enc := func(v wItem) ([]byte, error) { return []byte(v.name), nil }
+	dec := func(p []byte) (wItem, error) { return wItem{name: string(p)}, nil }
+
+	w, err := New([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+		wi("C", 1),
+	}, WithHistory(4))
+	assert(err == nil, "new: %v", err)
+
+	// pin sessions to every slot
+	for i := range 3 {
+		w.PickSession(fmt.Sprintf("s%d", i), time.Hour)
+	}
+	w.NextNoRepeat()
+	other := mustNew([]wItem{wi("X", 1)})
+	LinkAntiAffinity(other, w, map[int]int{0: 1})
+	LinkAntiAffinity(w, other, map[int]int{2: 0})
+
+	b, err := mustNew([]wItem{wi("P", 1), wi("Q", 1)}).MarshalBinaryWith(enc)
+	assert(err == nil, "marshal: %v", err)
+	err = w.UnmarshalBinaryWith(b, dec)
+	assert(err == nil, "unmarshal: %v", err)
+
+	assert(len(w.History()) == 0, "expected empty history, got %v", w.History())
+	assert(w.prev.Load() == 0, "NextNoRepeat still remembers a pick")
+	assert(w.anti.Load() == nil, "anti-affinity to the old slots kept")
+	l := other.anti.Load()
+	assert(l != nil && w.resized.Load() != l.resized, "link keyed by the old slots still active")
+
+	assert(len(w.sess.m) == 0, "sessions pinned to the old slots kept: %v", w.sess.m)
+}
@@ -0,0 +1,82 @@
+// metrics.go - OpenMetrics exposition of WRR state
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteOpenMetrics writes the configured weights, the cycle length
+// and, if WithStats() is set, the per-slot selection counts to 'wr'
+// in the OpenMetrics text exposition format, which Prometheus also
+// scrapes. Metric names are prefixed with 'name'; per-slot metrics
+// carry the slot index, in the original input order, in the "slot"
+// label:
+//
+//	<name>_weight{slot="0"} 5
+//	<name>_cycle_length 10
+//	<name>_selections_total{slot="0"} 17
+//
+// The output ends with the "# EOF" marker.
+func (w *WRR[T]) WriteOpenMetrics(wr io.Writer, name string) error {
+	if !validMetricName(name) {
+		return fmt.Errorf("wrr: bad metric name %q", name)
+	}
+
+	t := w.tab.Load()
+	b := bufio.NewWriter(wr)
+
+	fmt.Fprintf(b, "# TYPE %s_weight gauge\n", name)
+	fmt.Fprintf(b, "# HELP %s_weight Configured weight of the slot.\n", name)
+	for i, v := range t.wts {
+		fmt.Fprintf(b, "%s_weight{slot=\"%d\"} %d\n", name, w.ext(i), v)
+	}
+
+	fmt.Fprintf(b, "# TYPE %s_cycle_length gauge\n", name)
+	fmt.Fprintf(b, "# HELP %s_cycle_length Selections in one cycle of the schedule.\n", name)
+	fmt.Fprintf(b, "%s_cycle_length %d\n", name, t.size())
+
+	if t.stats != nil {
+		fmt.Fprintf(b, "# TYPE %s_selections counter\n", name)
+		fmt.Fprintf(b, "# HELP %s_selections Times the slot was selected.\n", name)
+		for i := range t.stats {
+			fmt.Fprintf(b, "%s_selections_total{slot=\"%d\"} %d\n", name, w.ext(i), t.stats[i].Load())
+		}
+	}
+
+	fmt.Fprintf(b, "# EOF\n")
+	return b.Flush()
+}
+
+// validMetricName returns true if s is a valid metric name:
+// [a-zA-Z_:][a-zA-Z0-9_:]*
+func validMetricName(s string) bool {
+	if len(s) == 0 {
+		return false
+	}
+
+	for i, c := range s {
+		switch {
+		case c == '_' || c == ':':
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,70 @@
+// metrics_test.go - tests for the OpenMetrics exposition
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestWriteOpenMetrics(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}, WithStats())
+	assert(err == nil, "new: %v", err)
+
+	for i := 0; i < 20; i++ {
+		w.Next()
+	}
+
+	var b bytes.Buffer
+	err = w.WriteOpenMetrics(&b, "lb_wrr")
+	assert(err == nil, "write: %v", err)
+
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	assert(lines[len(lines)-1] == "# EOF", "missing EOF marker: %q", lines[len(lines)-1])
+
+	meta := regexp.MustCompile(`^# (TYPE lb_wrr_\w+ (gauge|counter)|HELP lb_wrr_\w+ .+)$`)
+	sample := regexp.MustCompile(`^lb_wrr_[a-z_]+(\{slot="\d+"\})? \d+$`)
+	for _, l := range lines[:len(lines)-1] {
+		assert(meta.MatchString(l) || sample.MatchString(l), "bad line %q", l)
+	}
+
+	want := []string{
+		`lb_wrr_weight{slot="0"} 5`,
+		`lb_wrr_weight{slot="2"} 2`,
+		`lb_wrr_cycle_length 10`,
+		`# TYPE lb_wrr_selections counter`,
+		`lb_wrr_selections_total{slot="0"} 10`,
+		`lb_wrr_selections_total{slot="1"} 6`,
+	}
+	for _, s := range want {
+		assert(strings.Contains(b.String(), s+"\n"), "missing %q in:\n%s", s, b.String())
+	}
+
+	// no stats: no counters
+	b.Reset()
+	w = mustNew([]wItem{wi("A", 1)})
+	err = w.WriteOpenMetrics(&b, "x")
+	assert(err == nil, "write: %v", err)
+	assert(!strings.Contains(b.String(), "selections"), "unexpected counters:\n%s", b.String())
+
+	err = w.WriteOpenMetrics(&b, "0bad-name")
+	assert(err != nil, "expected bad name error")
+}
@@ -0,0 +1,394 @@
+// options.go - construction time options for WRR
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+	"math"
+)
+
+// Option configures optional behavior of a scheduler; options are
+// passed to the constructors.
+type Option func(o *options)
+
+type options struct {
+	stats    bool
+	sentinel bool
+	lru      bool
+	index    IndexType
+
+	// minimum number of appearances per cycle for a slot
+	floors []floor
+
+	// largest share of the cycle a slot may have; 0 if unchecked
+	dominance float64
+
+	// max iterations of the compile loop; 0 if unbounded
+	budget int
+
+	// max entries in the compiled table; 0 for maxSeqLen
+	maxSeq int
+
+	// method used to order the table
+	apportion Apportionment
+
+	// number of recent selections to record; 0 if none
+	history int
+
+	// number of cursors Next() spreads over; 0 for the shared one
+	shards int
+}
+
+type floor struct {
+	index int
+	min   int
+}
+
+// WithStats enables per-slot selection counters. Every selection
+// made through the scheduler is counted; see Stats().
+func WithStats() Option {
+	return func(o *options) {
+		o.stats = true
+	}
+}
+
+// WithHistory records the slot indices of the last 'k' selections
+// made through the scheduler in a ring buffer; see History(). This
+// is meant for debugging unexpected routing. k <= 0 records nothing.
+func WithHistory(k int) Option {
+	return func(o *options) {
+		o.history = max(k, 0)
+	}
+}
+
+// WithSharding makes Next() draw its positions from 'n' independent
+// cursors, each on its own cache line, instead of the single shared
+// cursor; each call picks a cursor at random. This avoids contention
+// on one counter when many goroutines on many cores call Next()
+// concurrently. Each cursor walks the full cycle, starting at evenly
+// spaced phases, so every cursor keeps the exact proportions and so
+// do all of them together; the interleaving of consecutive
+// selections is only as smooth as the random choice of cursor.
+//
+// Only Next(), and NextEpoch() and Serve() which select like it, are
+// sharded. Position(), SetPosition(), Reset() and
+// ScheduleWeightChange() refer to the shared cursor used by the other
+// selection methods, which Next() then doesn't move. Likewise
+// Peek(), Upcoming(), Simulate(), UnseenAfter() and RealizationLag()
+// read the shared cursor: they describe the unsharded selection
+// methods, not Next(), whose cursor is chosen at random on each
+// call. n <= 1 disables sharding.
+func WithSharding(n int) Option {
+	return func(o *options) {
+		o.shards = n
+	}
+}
+
+// IndexType is the width of the slot indices held in the compiled
+// table; it bounds the number of slots a scheduler can hold.
+type IndexType int
+
+const (
+	// Auto holds indices in 8 bits when there are at most 256
+	// slots, in 16 bits when there are fewer than 65536 and in 32
+	// bits otherwise. This is the default.
+	Auto IndexType = iota
+
+	// Uint16 holds indices in 16 bits: fewer than 65536 slots.
+	Uint16
+
+	// Uint32 holds indices in 32 bits at twice the table memory.
+	Uint32
+
+	// Uint8 holds indices in 8 bits at half the table memory of
+	// Uint16: at most 256 slots.
+	Uint8
+)
+
+// index is the set of table index types
+type index interface {
+	~uint8 | ~uint16 | ~uint32
+}
+
+// WithIndexType selects the width of the slot indices in the
+// compiled table. Construction fails if the number of slots
+// doesn't fit the chosen width.
+func WithIndexType(t IndexType) Option {
+	return func(o *options) {
+		o.index = t
+	}
+}
+
+// bits returns the width in bits of the indices for n slots
+func (t IndexType) bits(n int) int {
+	switch {
+	case t == Uint32 || (t == Auto && n >= 65536):
+		return 32
+	case t == Uint8 || (t == Auto && n <= 256):
+		return 8
+	}
+	return 16
+}
+
+// check returns an error if n slots don't fit the index type
+func (t IndexType) check(n int) error {
+	switch t {
+	case Uint8:
+		if n > 256 {
+			return fmt.Errorf("wrr: too many WRR slots (%d) for 8-bit indices", n)
+		}
+	case Uint16:
+		if n >= 65536 {
+			return fmt.Errorf("wrr: too many WRR slots (%d)", n)
+		}
+	case Auto, Uint32:
+		if uint64(n) > math.MaxUint32 {
+			return fmt.Errorf("wrr: too many WRR slots (%d)", n)
+		}
+	default:
+		return fmt.Errorf("wrr: unknown index type %d", t)
+	}
+	return nil
+}
+
+// WithMinRate guarantees that the slot at 'index' (in the original
+// input order) appears at least 'minPerCycle' times in every cycle
+// of the schedule, regardless of how light it is relative to the
+// others. When the floor binds, the shortfall is borrowed one
+// selection at a time from the heaviest slots, so the cycle length
+// is unchanged but the heavier slots lose some of their share and
+// the configured proportions are no longer exact. Construction
+// fails if the floor cannot be met.
+//
+// The floor doesn't apply while the slot has weight 0: a disabled
+// slot is never selected.
+//
+// The option may be given once per slot; a later floor for the same
+// slot replaces an earlier one.
+func WithMinRate(index int, minPerCycle int) Option {
+	return func(o *options) {
+		o.floors = append(o.floors, floor{index, minPerCycle})
+	}
+}
+
+// WithSentinelZero reserves index 0 to mean "no selection" for
+// interop with protocols that use 0 as unassigned. Slot indices
+// reported by the scheduler, in return values and to callbacks such
+// as Breaker, are offset by one: the first slot is 1, and so are the
+// indices a NextWithPreemptQueue() source returns, so that reported
+// indices can be fed back. Methods that fail to select a slot report
+// 0 instead of -1. Slices indexed by slot and passed in by the
+// caller, e.g., the ready set for NextReady(), are not offset.
+func WithSentinelZero() Option {
+	return func(o *options) {
+		o.sentinel = true
+	}
+}
+
+// WithLRUTieBreak changes how the schedule is compiled: when two or
+// more slots have equal credit, the slot selected longest ago wins
+// instead of the one with the lowest index. This is an alternative
+// smoothing heuristic; for some weight sets it spreads the lighter
+// slots more evenly through the cycle, for most it changes nothing.
+// The proportions are the same either way.
+func WithLRUTieBreak() Option {
+	return func(o *options) {
+		o.lru = true
+	}
+}
+
+// WithDominanceCheck makes construction, and any later
+// reconfiguration, fail if one slot would get more than 'threshold'
+// of the selections in a cycle, e.g., 0.9; this guards against an
+// accidental near single backend configuration. The share is that
+// of the compiled schedule, after any WithMinRate() floors. The
+// threshold must be in (0, 1].
+func WithDominanceCheck(threshold float64) Option {
+	return func(o *options) {
+		o.dominance = threshold
+	}
+}
+
+// checkDominance returns an error if a slot's share of the
+// normalized weights 'eff' exceeds the configured threshold.
+func (o *options) checkDominance(eff []int, tot int) error {
+	if o.dominance == 0 {
+		return nil
+	}
+	if !(o.dominance > 0 && o.dominance <= 1) {
+		return fmt.Errorf("wrr: bad dominance threshold %v", o.dominance)
+	}
+
+	for i, e := range eff {
+		if f := float64(e) / float64(tot); f > o.dominance {
+			return fmt.Errorf("wrr: slot index %d: share %.4f exceeds %v", i, f, o.dominance)
+		}
+	}
+	return nil
+}
+
+// WithBuildBudget bounds the work of compiling the schedule: the
+// construction, or a later reconfiguration, fails before the table
+// is allocated if compiling it would take more than 'maxOps'
+// iterations of the smoothing loop. The cost is estimated as the
+// table size times the number of slots; uniform weights compile in
+// one pass over the slots. This protects against crafted weights in
+// untrusted configuration.
+func WithBuildBudget(maxOps int) Option {
+	return func(o *options) {
+		o.budget = maxOps
+	}
+}
+
+// checkBudget returns an error if compiling a table of 'tot' entries
+// over n slots exceeds the build budget; 'uni' is true if the weights
+// are uniform (see uniform()), which compile in one pass.
+func (o *options) checkBudget(n, tot int, uni bool) error {
+	if o.budget <= 0 {
+		return nil
+	}
+
+	ops := tot * n
+	if uni {
+		ops = n
+	}
+	if ops > o.budget {
+		return fmt.Errorf("wrr: build needs %d ops (%d entries x %d slots), budget %d",
+			ops, tot, n, o.budget)
+	}
+	return nil
+}
+
+// WithMaxSeqLen sets the largest compiled table, i.e., the largest
+// sum of the gcd-reduced weights, that construction or a later
+// reconfiguration accepts; the default is 1<<20 entries. Coprime
+// weights aren't reduced by their gcd, so e.g. {999983, 999979}
+// need a table of nearly two million entries. Each entry takes two
+// bytes, or four with Uint32 indices.
+func WithMaxSeqLen(n int) Option {
+	return func(o *options) {
+		o.maxSeq = n
+	}
+}
+
+// checkSeqLen returns an error if a table of 'tot' entries exceeds
+// the configured maximum.
+func (o *options) checkSeqLen(tot int) error {
+	lim := maxSeqLen
+	if o.maxSeq != 0 {
+		lim = o.maxSeq
+	}
+
+	if lim < 1 {
+		return fmt.Errorf("wrr: bad max sequence length %d", lim)
+	}
+	if tot > lim {
+		return fmt.Errorf("wrr: schedule too large: gcd-reduced weights sum to %d, max %d; rescale the weights to a smaller sum, e.g., with SuggestWeights()",
+			tot, lim)
+	}
+	return nil
+}
+
+// Apportionment is the method used to order the selections within a
+// cycle of the schedule.
+type Apportionment int
+
+const (
+	// Smooth is the Nginx style smooth weighted round-robin: every
+	// step each slot gains credit equal to its weight and the slot
+	// with the most credit is selected and pays the total weight.
+	// This is the default.
+	Smooth Apportionment = iota
+
+	// Webster orders the selections by the Sainte-Laguë highest
+	// averages method: each step selects the slot with the largest
+	// w/(2s+1), where s is the number of times it was selected in
+	// the cycle so far.
+	Webster
+
+	// DHondt orders the selections by the D'Hondt highest averages
+	// method: each step selects the slot with the largest w/(s+1).
+	DHondt
+)
+
+// WithApportionment selects the method used to order the selections
+// within a cycle; ties go to the lowest index. Every method selects
+// each slot exactly its (gcd-reduced) weight times per cycle; they
+// differ in how the selections are spread, i.e., in the seats each
+// slot holds after the first few selections. The smooth default
+// and Webster are both balanced and often agree; D'Hondt favors the
+// heavier slots early in the cycle. E.g., for the weights {5,3,2}:
+//
+//	Smooth:  A B C A A B A C B A
+//	Webster: A B C A A B A C B A
+//	DHondt:  A B A C A B A A B C
+//
+// WithLRUTieBreak() only applies to Smooth.
+func WithApportionment(a Apportionment) Option {
+	return func(o *options) {
+		o.apportion = a
+	}
+}
+
+func makeOptions(opts []Option) options {
+	var o options
+
+	for _, fp := range opts {
+		fp(&o)
+	}
+	return o
+}
+
+// applyFloors raises the normalized weights 'eff' to the configured
+// floors by borrowing from the heaviest unfloored slots. Disabled
+// slots stay at 0.
+func (o *options) applyFloors(eff []int) error {
+	if len(o.floors) == 0 {
+		return nil
+	}
+
+	n := len(eff)
+	mins := make([]int, n)
+	for _, f := range o.floors {
+		if f.index < 0 || f.index >= n {
+			return fmt.Errorf("wrr: min rate: bad slot index %d", f.index)
+		}
+		if f.min < 0 {
+			return fmt.Errorf("wrr: slot index %d: bad min rate %d", f.index, f.min)
+		}
+		mins[f.index] = f.min
+	}
+
+	for i, m := range mins {
+		if eff[i] == 0 {
+			continue
+		}
+		for eff[i] < m {
+			// the donor must stay above its own floor and weight 1
+			d := -1
+			for j := range eff {
+				if j != i && eff[j] > max(mins[j], 1) && (d < 0 || eff[j] > eff[d]) {
+					d = j
+				}
+			}
+			if d < 0 {
+				return fmt.Errorf("wrr: slot index %d: can't guarantee min rate %d", i, m)
+			}
+			eff[d]--
+			eff[i]++
+		}
+	}
+	return nil
+}
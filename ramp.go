@@ -0,0 +1,133 @@
+// ramp.go - gradual re-enabling of a disabled slot
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+)
+
+// ramp raises the weight of one slot from 1 to 'target' over 'steps'
+// selections.
+type ramp[T any] struct {
+	index  int
+	target int
+	steps  uint64
+
+	n   atomic.Uint64 // selections since the ramp began
+	cur atomic.Int64  // weight of the slot in the published table
+
+	// table published by the last step; guarded by WRR.mu
+	last *table[T]
+}
+
+// weight returns the weight of the slot after n selections
+func (r *ramp[T]) weight(n uint64) int {
+	n = min(n, r.steps)
+	return 1 + int(uint64(r.target-1)*n/r.steps)
+}
+
+// EnableWithRamp re-enables the slot at 'index' (in the original
+// input order), which must have been disabled by setting its weight
+// to 0, e.g., with UpdateWeights(). Rather than resuming its former
+// weight at once the slot restarts at weight 1 and its weight rises
+// linearly back to the weight it had before it was disabled over the
+// next 'steps' selections, recompiling the schedule at every step;
+// this avoids a spike of traffic to a slot that just recovered.
+//
+// The steps are taken inside the selections that cross them. A
+// selection that finds another goroutine reconfiguring leaves the
+// step to a later one instead of blocking. Any other reconfiguration
+// of the scheduler, including a ScheduleWeightChange(), ends the
+// ramp at the weight it has reached.
+func (w *WRR[T]) EnableWithRamp(index int, steps int) error {
+	if steps < 1 {
+		return fmt.Errorf("wrr: ramp: bad steps %d", steps)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if index < 0 || index >= len(t.slots) {
+		return fmt.Errorf("wrr: ramp: bad slot index %d", index)
+	}
+	if t.wts[index] != 0 {
+		return fmt.Errorf("wrr: ramp: slot index %d is not disabled", index)
+	}
+	if t.drained == nil || t.drained[index] == 0 {
+		return fmt.Errorf("wrr: ramp: slot index %d has no weight to restore", index)
+	}
+
+	r := &ramp[T]{
+		index:  index,
+		target: t.drained[index],
+		steps:  uint64(steps),
+	}
+
+	wts := slices.Clone(t.wts)
+	wts[index] = 1
+	nt, err := w.compileFor(t, wts)
+	if err != nil {
+		return err
+	}
+
+	w.publish(t, nt)
+	r.cur.Store(1)
+	r.last = nt
+	if r.target > 1 {
+		w.ramp.Store(r)
+	} else {
+		w.ramp.Store(nil)
+	}
+	return nil
+}
+
+// stepRamp counts k selections toward the ramp 'r' and, once they
+// call for a higher weight, recompiles the table with it.
+func (w *WRR[T]) stepRamp(r *ramp[T], k uint64) {
+	wt := r.weight(r.n.Add(k))
+	if int64(wt) <= r.cur.Load() || !w.mu.TryLock() {
+		return
+	}
+	defer w.mu.Unlock()
+
+	if w.ramp.Load() != r {
+		return
+	}
+
+	// reconfigured since the last step
+	t := w.tab.Load()
+	if t != r.last || w.pending.Load() != nil {
+		w.ramp.Store(nil)
+		return
+	}
+
+	wts := slices.Clone(t.wts)
+	wts[r.index] = wt
+	nt, err := w.compileFor(t, wts)
+	if err != nil {
+		w.ramp.Store(nil)
+		return
+	}
+
+	w.publish(t, nt)
+	r.cur.Store(int64(wt))
+	r.last = nt
+	if wt == r.target {
+		w.ramp.Store(nil)
+	}
+}
@@ -0,0 +1,104 @@
+// ramp_test.go - tests for re-enabling with a ramp
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestEnableWithRamp(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 4),
+		wi("B", 4),
+	})
+
+	err := w.EnableWithRamp(1, 10)
+	assert(err != nil, "expected error for a slot that isn't disabled")
+
+	// drain B, then bring it back over 40 selections
+	err = w.UpdateWeights([]int{4, 0})
+	assert(err == nil, "update: %v", err)
+	m := tally(w, 10)
+	assert(m["B"] == 0, "drained B selected %d times", m["B"])
+
+	err = w.EnableWithRamp(1, 40)
+	assert(err == nil, "ramp: %v", err)
+	assert(slices.Equal(w.Weights(), []int{4, 1}), "expected weights {4,1}, got %v", w.Weights())
+
+	// B's weight rises with every window of 10 selections
+	m = tally(w, 10)
+	assert(m["B"] <= 2, "first window: expected B at most 2 of 10, got %d", m["B"])
+	for i, x := range []int{2, 3, 4} {
+		tally(w, 10)
+		v := w.Weights()[1]
+		assert(v == x, "window %d: expected B at weight %d, got %d", i+1, x, v)
+	}
+
+	// back at its former weight
+	assert(slices.Equal(w.Weights(), []int{4, 4}), "expected weights {4,4}, got %v", w.Weights())
+	assert(w.ramp.Load() == nil, "ramp still active")
+	m = tally(w, 10)
+	assert(m["A"] == 5 && m["B"] == 5, "after ramp: expected 5/5, got %v", m)
+
+	// another reconfiguration ends the ramp
+	err = w.UpdateWeights([]int{4, 0})
+	assert(err == nil, "update: %v", err)
+	err = w.EnableWithRamp(1, 40)
+	assert(err == nil, "ramp: %v", err)
+	err = w.UpdateWeights([]int{4, 2})
+	assert(err == nil, "update: %v", err)
+	tally(w, 100)
+	assert(slices.Equal(w.Weights(), []int{4, 2}), "ramp overrode update: %v", w.Weights())
+
+	// a slot that was never enabled has nothing to restore
+	z := mustNew([]wItem{wi("A", 1), wi("B", 0)})
+	err = z.EnableWithRamp(1, 10)
+	assert(err != nil, "expected error for a slot without a former weight")
+	err = z.EnableWithRamp(2, 10)
+	assert(err != nil, "expected error for bad index")
+	err = z.EnableWithRamp(1, 0)
+	assert(err != nil, "expected error for bad steps")
+}
+
+func TestEnableWithRampConcurrent(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 8),
+		wi("B", 8),
+	})
+
+	err := w.UpdateWeights([]int{8, 0})
+	assert(err == nil, "update: %v", err)
+	err = w.EnableWithRamp(1, 1000)
+	assert(err == nil, "ramp: %v", err)
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				w.Next()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the last step may have been left to a later selection
+	w.Next()
+	assert(slices.Equal(w.Weights(), []int{8, 8}), "expected weights {8,8}, got %v", w.Weights())
+}
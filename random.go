@@ -0,0 +1,114 @@
+// random.go - weighted random selection
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"sort"
+)
+
+// Returns an item drawn at random in proportion to the weights,
+// independently of every other draw; e.g., for sampling or load
+// shedding. The smooth cursor is neither used nor moved. Draws use
+// 'rng', which lets callers seed it for reproducible sequences; a
+// nil 'rng' uses the global source of math/rand/v2. A *rand.Rand is
+// not safe for concurrent use, so concurrent callers need their own.
+// O(log n) in the number of slots.
+func (w *WRR[T]) NextRandom(rng *rand.Rand) T {
+	t := w.tab.Load()
+	tot := t.cdf[len(t.cdf)-1]
+
+	var r int
+	if rng != nil {
+		r = rng.IntN(tot)
+	} else {
+		r = rand.IntN(tot)
+	}
+
+	// first slot whose running sum passes r; slots of weight 0
+	// have the same sum as the one before them and are skipped.
+	j := sort.Search(len(t.cdf), func(i int) bool {
+		return t.cdf[i] > r
+	})
+	t.count(j)
+	return t.slots[j]
+}
+
+// SampleK draws 'k' distinct items at random, each draw in proportion
+// to the weights of the items not drawn yet; e.g., to pick 3 of 10
+// replicas for a fan-out read. This is weighted sampling without
+// replacement by the Efraimidis-Spirakis method: every slot gets the
+// key u^(1/w) for a uniform random u and the k largest keys win, in
+// order of their keys. Slots of weight 0 are never drawn. Like
+// NextRandom() the cursor is neither used nor moved and a nil 'rng'
+// uses the global source of math/rand/v2.
+//
+// Returns an error if k is negative or more than the number of slots
+// of positive weight.
+func (w *WRR[T]) SampleK(k int, rng *rand.Rand) ([]T, error) {
+	t := w.tab.Load()
+
+	type key struct {
+		k float64
+		j int
+	}
+
+	keys := make([]key, 0, len(t.eff))
+	for j, e := range t.eff {
+		if e == 0 {
+			continue
+		}
+
+		var u float64
+		if rng != nil {
+			u = rng.Float64()
+		} else {
+			u = rand.Float64()
+		}
+
+		// log(u^(1/w)) orders the same and doesn't underflow
+		keys = append(keys, key{math.Log(u) / float64(e), j})
+	}
+	if k < 0 || k > len(keys) {
+		return nil, fmt.Errorf("wrr: can't sample %d of %d slots", k, len(keys))
+	}
+
+	slices.SortFunc(keys, func(a, b key) int {
+		return cmp.Compare(b.k, a.k)
+	})
+
+	v := make([]T, k)
+	for i := range v {
+		j := keys[i].j
+		t.count(j)
+		v[i] = t.slots[j]
+	}
+	return v, nil
+}
+
+// cumulative returns the running sum of 'eff'
+func cumulative(eff []int) []int {
+	cdf := make([]int, len(eff))
+	sum := 0
+	for i, e := range eff {
+		sum += e
+		cdf[i] = sum
+	}
+	return cdf
+}
@@ -0,0 +1,114 @@
+// random_test.go - tests for weighted random selection
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"math"
+	"math/rand/v2"
+	"testing"
+)
+
+func TestNextRandom(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 0),
+		wi("C", 3),
+		wi("D", 2),
+	})
+
+	n := 100000
+	rng := rand.New(rand.NewPCG(1, 2))
+	m := make(map[string]int)
+	for i := 0; i < n; i++ {
+		m[w.NextRandom(rng).name]++
+	}
+
+	want := map[string]float64{"A": 0.5, "B": 0, "C": 0.3, "D": 0.2}
+	for k, p := range want {
+		f := float64(m[k]) / float64(n)
+		assert(math.Abs(f-p) < 0.01, "%s: expected share %v, got %v", k, p, f)
+	}
+
+	// the cursor is untouched
+	v := w.Next()
+	assert(v.name == "A", "cursor moved: expected A, got %s", v.name)
+
+	// seeded sources are reproducible
+	a := rand.New(rand.NewPCG(7, 7))
+	b := rand.New(rand.NewPCG(7, 7))
+	for i := 0; i < 100; i++ {
+		x, y := w.NextRandom(a), w.NextRandom(b)
+		assert(x.name == y.name, "step %d: %s vs %s", i, x.name, y.name)
+	}
+
+	// the global source
+	for i := 0; i < 100; i++ {
+		x := w.NextRandom(nil)
+		assert(x.name != "B", "disabled slot selected")
+	}
+}
+
+func TestSampleK(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 0),
+		wi("C", 3),
+		wi("D", 2),
+		wi("E", 10),
+	})
+
+	n := 20000
+	rng := rand.New(rand.NewPCG(1, 2))
+	m := make(map[string]int)
+	first := make(map[string]int)
+	for i := 0; i < n; i++ {
+		v, err := w.SampleK(3, rng)
+		assert(err == nil, "sample: %v", err)
+		assert(len(v) == 3, "expected 3 items, got %d", len(v))
+
+		seen := make(map[string]bool)
+		for _, x := range v {
+			assert(!seen[x.name], "draw %d: %s repeated in %v", i, x.name, v)
+			seen[x.name] = true
+			m[x.name]++
+		}
+		first[v[0].name]++
+	}
+
+	assert(m["B"] == 0, "disabled slot B drawn %d times", m["B"])
+	assert(m["E"] > m["A"] && m["A"] > m["C"] && m["C"] > m["D"],
+		"expected heavier items drawn more often: %v", m)
+
+	// the first draw is proportional to the weights
+	want := map[string]float64{"A": 0.25, "C": 0.15, "D": 0.1, "E": 0.5}
+	for k, p := range want {
+		f := float64(first[k]) / float64(n)
+		assert(math.Abs(f-p) < 0.015, "%s: expected first share %v, got %v", k, p, f)
+	}
+
+	// every slot of positive weight
+	v, err := w.SampleK(4, nil)
+	assert(err == nil, "sample: %v", err)
+	assert(len(v) == 4, "expected 4 items, got %d", len(v))
+
+	v, err = w.SampleK(0, rng)
+	assert(err == nil && len(v) == 0, "expected no items, got %v, %v", v, err)
+
+	_, err = w.SampleK(5, rng)
+	assert(err != nil, "expected error for more than the slots of positive weight")
+	_, err = w.SampleK(-1, rng)
+	assert(err != nil, "expected error for negative k")
+}
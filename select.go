@@ -0,0 +1,399 @@
+// select.go - constrained selection over a WRR schedule
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/bits"
+	"sync/atomic"
+)
+
+// Breaker reports whether the slot at the given index (in the
+// original input order, offset by one with WithSentinelZero()) may
+// be selected; e.g., whether its circuit breaker is closed.
+type Breaker interface {
+	Allow(index int) bool
+}
+
+// readySet is a compiled sub-schedule over a subset of the slots.
+// It is immutable except for its cursor.
+type readySet[T any] struct {
+	schedule // indices into idx
+
+	tab  *table[T] // table this was compiled from
+	sig  string
+	idx  []int // sub-schedule slot -> index into WRR.slots
+	next atomic.Uint64
+}
+
+// Returns the next item in the smooth weighted sequence restricted
+// to the slots marked true in 'ready'; the relative effective weights
+// of the ready slots, including any WithMinRate() floors, are
+// preserved. The second return value is the index of the item in the
+// original input order. Entries missing from 'ready' are treated as
+// not ready. Returns false if no slot of positive weight is ready.
+//
+// The sub-schedule for a given ready set is compiled on first use
+// and cached until a call with a different ready set; callers that
+// alternate between many ready sets will recompile frequently.
+func (w *WRR[T]) NextReady(ready []bool) (T, int, bool) {
+	var z T
+
+	t := w.tab.Load()
+	sig, k := readySig(ready, len(t.slots))
+	if k == 0 {
+		return z, w.none(), false
+	}
+
+	rs := w.ready.Load()
+	if rs == nil || rs.tab != t || rs.sig != sig {
+		rs = t.newReadySet(sig, ready, k)
+		w.ready.Store(rs)
+	}
+	if len(rs.idx) == 0 {
+		// only slots of weight 0 are ready
+		return z, w.none(), false
+	}
+
+	j := rs.idx[rs.at(rs.next.Add(1)-1)]
+	t.count(j)
+	return t.slots[j], w.ext(j), true
+}
+
+// newReadySet compiles a sub-schedule over the k ready slots
+func (t *table[T]) newReadySet(sig string, ready []bool, k int) *readySet[T] {
+	blk := make([]int, 2*k)
+	eff, cur := blk[:k], blk[k:]
+	idx := make([]int, 0, k)
+
+	tot := 0
+	for i := range t.slots {
+		if i < len(ready) && ready[i] && t.eff[i] > 0 {
+			eff[len(idx)] = t.eff[i]
+			tot += t.eff[i]
+			idx = append(idx, i)
+		}
+	}
+
+	rs := &readySet[T]{
+		tab: t,
+		sig: sig,
+		idx: idx,
+	}
+	if len(idx) == 0 {
+		return rs
+	}
+
+	// the ready set is a subset of already validated slots
+	// and fits the width of the parent table.
+	eff, tot = normalize(eff[:len(idx)], tot)
+	rs.eff = eff
+	switch {
+	case t.narrow != nil:
+		rs.narrow, _ = compile[uint8](eff, cur[:len(idx)], tot)
+	case t.wide != nil:
+		rs.wide, _ = compile[uint32](eff, cur[:len(idx)], tot)
+	default:
+		rs.seq, _ = compile[uint16](eff, cur[:len(idx)], tot)
+	}
+	return rs
+}
+
+// readySig returns a compact signature of the first n entries of
+// 'ready' suitable as a cache key, and the number of ready slots.
+func readySig(ready []bool, n int) (string, int) {
+	var k int
+
+	b := make([]byte, (n+7)/8)
+	for i := range min(n, len(ready)) {
+		if ready[i] {
+			b[i/8] |= 1 << (i % 8)
+			k++
+		}
+	}
+	return string(b), k
+}
+
+// Returns the next item in the smooth weighted sequence whose
+// breaker allows it, along with its index in the original input
+// order. Positions whose slot is not allowed are consumed so the
+// allowed slots keep their relative weights. Scans at most one
+// full cycle and returns false if every breaker is open.
+func (w *WRR[T]) NextAllowed(b Breaker) (T, int, bool) {
+	var z T
+
+	t, j, ok := w.nextWhere(func(_ *table[T], j int) bool {
+		return b.Allow(w.ext(j))
+	})
+	if !ok {
+		return z, w.none(), false
+	}
+	return t.slots[j], w.ext(j), true
+}
+
+// Returns the next item in the smooth weighted sequence whose slot is
+// marked true in 'allowed', along with its index in the original
+// input order. Unlike NextReady() nothing is compiled or cached: the
+// cursor advances until it lands on an allowed slot, consuming the
+// positions it skips. Entries missing from 'allowed' are treated as
+// not allowed. Scans at most one full cycle and returns false if no
+// slot is allowed.
+func (w *WRR[T]) NextMasked(allowed []bool) (T, int, bool) {
+	var z T
+
+	t, j, ok := w.nextWhere(func(_ *table[T], j int) bool {
+		return j < len(allowed) && allowed[j]
+	})
+	if !ok {
+		return z, w.none(), false
+	}
+	return t.slots[j], w.ext(j), true
+}
+
+// Returns the next item in the smooth weighted sequence for which
+// ok(item) is true, e.g., a health check, along with its index in the
+// original input order. Like NextAllowed() the positions of unhealthy
+// items are consumed, so the healthy items keep their relative
+// weights and nothing is recompiled when health changes. Scans at
+// most one full cycle and returns false if no item is healthy.
+func (w *WRR[T]) NextHealthy(ok func(T) bool) (T, int, bool) {
+	var z T
+
+	t, j, found := w.nextWhere(func(t *table[T], j int) bool {
+		return ok(t.slots[j])
+	})
+	if !found {
+		return z, w.none(), false
+	}
+	return t.slots[j], w.ext(j), true
+}
+
+// Returns the next item in the smooth weighted sequence that differs
+// from the one returned by the previous call, along with its index
+// in the original input order. When the smooth pick repeats the
+// previous slot the cursor advances again, at most one cycle, and
+// the skipped positions are consumed; so a slot with more than half
+// the total weight, which smoothing has to repeat, loses part of its
+// share to the others. With a single slot of positive weight it is
+// always returned. Concurrent callers each see "previous" as the most
+// recent pick by any of them.
+func (w *WRR[T]) NextNoRepeat() (T, int) {
+	prev := int(w.prev.Load()) - 1
+	t, j, ok := w.nextWhere(func(t *table[T], j int) bool {
+		return j != prev || t.single()
+	})
+	if !ok {
+		// can't happen with more than one slot in a cycle
+		t, j = w.pick()
+	}
+	w.prev.Store(int64(j) + 1)
+	return t.slots[j], w.ext(j)
+}
+
+// nextWhere advances the cursor until it lands on a slot for which
+// ok() is true and returns the table and slot index. ok() is given
+// the table the slot index belongs to. Scans at most one cycle.
+func (w *WRR[T]) nextWhere(ok func(*table[T], int) bool) (*table[T], int, bool) {
+	t := w.tab.Load()
+	for range t.size() {
+		var c uint64
+
+		t, c = w.advance(1)
+		j := t.at(c)
+		if ok(t, j) {
+			t.count(j)
+			return t, j, true
+		}
+	}
+	return t, -1, false
+}
+
+// Returns the item chosen by an external preemption source if it has
+// one, else the next item in the smooth weighted sequence, along with
+// its index in the original input order. 'pq' is consulted first: if
+// it returns true the slot at the index it returns (in the original
+// input order) is selected and the cursor doesn't move, so the
+// weighted sequence resumes unchanged once the preemptions stop; this
+// lets e.g. a real-time priority queue override the weighted base.
+// An index out of range, or of a slot with weight 0, is ignored and
+// the smooth pick is taken. With WithSentinelZero() the index from
+// 'pq' is offset by one like the indices returned.
+func (w *WRR[T]) NextWithPreemptQueue(pq func() (int, bool)) (T, int) {
+	if j, ok := pq(); ok {
+		j = w.internal(j)
+		t := w.tab.Load()
+		if j >= 0 && j < len(t.slots) && t.eff[j] > 0 {
+			t.count(j)
+			return t.slots[j], w.ext(j)
+		}
+	}
+
+	t, j := w.pick()
+	return t.slots[j], w.ext(j)
+}
+
+// Returns the next item in the smooth weighted sequence unless that
+// slot is overloaded, in which case the least loaded slot is returned
+// instead; the second return value is the index of the item in the
+// original input order. 'load' holds the caller's current load for
+// each slot in input order.
+//
+// The smooth pick is overridden when its load is more than 'factor'
+// times the minimum load across the enabled slots, where a minimum
+// of zero counts as one; e.g., 2 tolerates up to twice the minimum.
+// A factor below 1 is taken as 1. Slots with weight 0 are never
+// picked and ties for the least loaded slot go to the lowest index.
+// The cursor always advances, so the weighted cycle continues as
+// though the smooth pick was taken. If 'load' doesn't have an entry
+// for every slot the smooth pick is returned.
+func (w *WRR[T]) NextOrLeastLoaded(load []int, factor float64) (T, int) {
+	t, c := w.advance(1)
+	j := t.at(c)
+
+	if len(load) == len(t.slots) {
+		lo := -1
+		for k := range load {
+			if t.eff[k] == 0 {
+				continue
+			}
+			if lo < 0 || load[k] < load[lo] {
+				lo = k
+			}
+		}
+		if float64(load[j]) > max(factor, 1)*float64(max(load[lo], 1)) {
+			j = lo
+		}
+	}
+
+	t.count(j)
+	return t.slots[j], w.ext(j)
+}
+
+// Returns the item for the value 'v' in the range [lo, hi] along
+// with its index in the original input order. The range is mapped
+// proportionally onto one cycle of the schedule, so values spread
+// uniformly across the range are distributed across the slots by
+// weight; the same value always maps to the same slot. Values
+// outside the range are clamped to it. The cursor is not used.
+func (w *WRR[T]) SelectForValue(v, lo, hi int) (T, int) {
+	if lo > hi {
+		lo, hi = hi, lo
+	}
+	v = min(max(v, lo), hi)
+
+	t := w.tab.Load()
+
+	// off*size/span without overflow; off < span so the quotient
+	// is always < size.
+	off := uint64(v) - uint64(lo)
+	span := uint64(hi) - uint64(lo) + 1
+	ph, pl := bits.Mul64(off, uint64(t.size()))
+
+	var p uint64
+	if span == 0 {
+		// the range covers every int
+		p = ph
+	} else {
+		p, _ = bits.Div64(ph, pl, span)
+	}
+
+	j := t.at(p)
+	t.count(j)
+	return t.slots[j], w.ext(j)
+}
+
+// Returns the item for the composite key made of 'features', e.g., a
+// user and a path, along with its index in the original input order.
+// The features are hashed with FNV-1a, each prefixed by its length so
+// that {"ab", "c"} and {"a", "bc"} are different keys, and the hash
+// is mapped proportionally onto one cycle of the schedule: the same
+// features always map to the same slot and a uniform stream of keys
+// is distributed across the slots by weight. The cursor is not used.
+func (w *WRR[T]) PickFeatures(features ...[]byte) (T, int) {
+	h := fnv.New64a()
+
+	var b [8]byte
+	for _, f := range features {
+		binary.LittleEndian.PutUint64(b[:], uint64(len(f)))
+		h.Write(b[:])
+		h.Write(f)
+	}
+
+	t := w.tab.Load()
+	p, _ := bits.Mul64(h.Sum64(), uint64(t.size()))
+	j := t.at(p)
+	t.count(j)
+	return t.slots[j], w.ext(j)
+}
+
+// antiLink makes a scheduler avoid slots based on the last pick of
+// another scheduler.
+type antiLink[T any] struct {
+	src    *WRR[T]
+	forbid map[int]int
+
+	// src.resized when the link was made
+	resized uint64
+}
+
+// LinkAntiAffinity makes b.Next() avoid selecting forbidden[i]
+// whenever the most recent a.Next() selected slot i; e.g., to keep
+// two replicas off the same rack. When b's smooth pick is forbidden,
+// b advances once more and takes the next pick instead. This is best
+// effort: the next pick may also be forbidden, and concurrent callers
+// of a.Next() may change a's last pick mid-selection. The skipped
+// positions are consumed so b's proportions shift slightly away from
+// the forbidden slots.
+//
+// Indices are in the original input order of each scheduler. The
+// map is copied; a nil or empty map removes the link. Removing a
+// slot from b drops the entries that forbid it and renumbers the
+// rest; adding or removing slots of a ends the link, as its keys no
+// longer name a's slots.
+func LinkAntiAffinity[T any](a, b *WRR[T], forbidden map[int]int) {
+	if len(forbidden) == 0 {
+		b.anti.Store(nil)
+		return
+	}
+
+	l := &antiLink[T]{
+		src:     a,
+		forbid:  make(map[int]int, len(forbidden)),
+		resized: a.resized.Load(),
+	}
+	for k, v := range forbidden {
+		l.forbid[k] = v
+	}
+
+	if !a.track.Load() {
+		a.last.Store(-1)
+		a.track.Store(true)
+	}
+	b.anti.Store(l)
+}
+
+// avoid returns the slot w should select in place of its smooth
+// pick j from table t.
+func (l *antiLink[T]) avoid(w *WRR[T], t *table[T], j int) int {
+	if l.src.resized.Load() != l.resized {
+		return j
+	}
+	if f, ok := l.forbid[int(l.src.last.Load())]; ok && f == j {
+		_, c := w.advance(1)
+		return t.at(c)
+	}
+	return j
+}
@@ -0,0 +1,498 @@
+// select_test.go - tests for constrained selection
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestNextReadySubset(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+		wi("D", 1),
+	})
+
+	ready := []bool{true, false, true, true}
+	m := make(map[string]int)
+	for i := 0; i < 800; i++ {
+		v, j, ok := w.NextReady(ready)
+		assert(ok, "expected a ready slot")
+		assert(ready[j], "slot %d is not ready", j)
+		assert(w.tab.Load().slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+		m[v.name]++
+	}
+
+	// ready weights 5:2:1 over 100 cycles of 8
+	assert(m["A"] == 500, "A: expected 500, got %d", m["A"])
+	assert(m["B"] == 0, "B: expected 0, got %d", m["B"])
+	assert(m["C"] == 200, "C: expected 200, got %d", m["C"])
+	assert(m["D"] == 100, "D: expected 100, got %d", m["D"])
+}
+
+func TestNextReadyMinRate(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 100),
+		wi("B", 1),
+		wi("C", 1),
+	}, WithMinRate(1, 50))
+	assert(err == nil, "new: %v", err)
+	assert(slices.Equal(w.EffectiveWeights(), []int{51, 50, 1}), "unexpected effective weights %v", w.EffectiveWeights())
+
+	// the floor holds within the ready subset: 51:50
+	ready := []bool{true, true, false}
+	m := make(map[string]int)
+	for i := 0; i < 1010; i++ {
+		v, _, ok := w.NextReady(ready)
+		assert(ok, "expected a ready slot")
+		m[v.name]++
+	}
+	assert(m["A"] == 510, "A: expected 510, got %d", m["A"])
+	assert(m["B"] == 500, "B: expected 500, got %d", m["B"])
+}
+
+func TestNextReadyNone(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+	})
+
+	_, j, ok := w.NextReady([]bool{false, false})
+	assert(!ok, "expected no ready slot, got %d", j)
+
+	// short ready slice: missing entries aren't ready
+	_, j, ok = w.NextReady(nil)
+	assert(!ok, "expected no ready slot, got %d", j)
+
+	v, j, ok := w.NextReady([]bool{false, true})
+	assert(ok && j == 1 && v.name == "B", "expected B, got %s (%d)", v.name, j)
+}
+
+// fakeBreaker is open for the slots marked true
+type fakeBreaker []bool
+
+func (b fakeBreaker) Allow(i int) bool { return !b[i] }
+
+func TestNextAllowed(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	// B's breaker is open
+	b := fakeBreaker{false, true, false}
+	m := make(map[string]int)
+	for i := 0; i < 700; i++ {
+		v, j, ok := w.NextAllowed(b)
+		assert(ok, "expected an allowed slot")
+		assert(j != 1, "open slot %d selected", j)
+		m[v.name]++
+	}
+
+	// A and C keep their relative weights of 5:2
+	assert(m["B"] == 0, "B: expected 0, got %d", m["B"])
+	assert(m["A"]*2 == m["C"]*5, "A:C expected 5:2, got %d:%d", m["A"], m["C"])
+
+	_, j, ok := w.NextAllowed(fakeBreaker{true, true, true})
+	assert(!ok, "expected no allowed slot, got %d", j)
+}
+
+func TestNextOrLeastLoaded(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 3),
+		wi("B", 1),
+		wi("C", 1),
+	})
+
+	// balanced load: plain smooth picks
+	w2 := mustNew(w.tab.Load().slots)
+	for i := 0; i < 50; i++ {
+		v, _ := w.NextOrLeastLoaded([]int{4, 3, 3}, 2)
+		assert(v.name == w2.Next().name, "step %d: unexpected override to %s", i, v.name)
+	}
+
+	// A is overloaded relative to C: every A pick goes to C
+	m := make(map[string]int)
+	for i := 0; i < 500; i++ {
+		v, j := w.NextOrLeastLoaded([]int{10, 4, 2}, 2)
+		assert(j != 0, "overloaded slot A selected")
+		m[v.name]++
+	}
+	assert(m["B"] == 100, "B: expected 100, got %d", m["B"])
+	assert(m["C"] == 400, "C: expected 400, got %d", m["C"])
+
+	// a looser threshold tolerates the same load
+	w3 := mustNew(w.tab.Load().slots)
+	for i := 0; i < 50; i++ {
+		v, _ := w3.NextOrLeastLoaded([]int{10, 4, 2}, 5)
+		assert(v.name == w2.Next().name, "step %d: unexpected override to %s", i, v.name)
+	}
+
+	// a tighter one overrides a smaller excess
+	for i := 0; i < 50; i++ {
+		_, j := w3.NextOrLeastLoaded([]int{4, 3, 3}, 1.2)
+		assert(j != 0, "step %d: overloaded slot A selected", i)
+	}
+
+	// below 1 acts as 1: equal loads are never overridden
+	w3, w4 := mustNew(w.tab.Load().slots), mustNew(w.tab.Load().slots)
+	for i := 0; i < 50; i++ {
+		v, _ := w3.NextOrLeastLoaded([]int{3, 3, 3}, 0.5)
+		assert(v.name == w4.Next().name, "step %d: unexpected override to %s", i, v.name)
+	}
+
+	// mismatched load is ignored
+	v, j := w.NextOrLeastLoaded([]int{100}, 2)
+	assert(v.name == w2.tab.Load().slots[j].name, "index %d doesn't match %s", j, v.name)
+
+	// an idle slot with weight 0 is never the least loaded
+	w = mustNew([]wItem{
+		wi("A", 1),
+		wi("B", 0),
+		wi("C", 1),
+	})
+	for i := 0; i < 10; i++ {
+		_, j := w.NextOrLeastLoaded([]int{10, 0, 10}, 2)
+		assert(j != 1, "step %d: disabled slot B selected", i)
+	}
+}
+
+func TestSelectForValue(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	// uniform values over the range
+	m := make(map[string]int)
+	for v := 1000; v < 2000; v++ {
+		x, _ := w.SelectForValue(v, 1000, 1999)
+		m[x.name]++
+	}
+	assert(m["A"] == 500, "A: expected 500, got %d", m["A"])
+	assert(m["B"] == 300, "B: expected 300, got %d", m["B"])
+	assert(m["C"] == 200, "C: expected 200, got %d", m["C"])
+
+	// stable mapping, clamping, and no cursor movement
+	a, i := w.SelectForValue(1234, 1000, 1999)
+	b, j := w.SelectForValue(1234, 1000, 1999)
+	assert(i == j && a.name == b.name, "unstable mapping: %d vs %d", i, j)
+
+	_, i = w.SelectForValue(-5, 1000, 1999)
+	_, j = w.SelectForValue(1000, 1000, 1999)
+	assert(i == j, "clamping: %d vs %d", i, j)
+
+	_, i = w.SelectForValue(0, math.MinInt, math.MaxInt)
+	assert(i >= 0 && i < 3, "full range: bad index %d", i)
+
+	v := w.Next()
+	assert(v.name == "A", "cursor moved: expected A, got %s", v.name)
+}
+
+func TestSentinelZero(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithSentinelZero())
+	assert(err == nil, "new: %v", err)
+
+	for i := 0; i < 20; i++ {
+		v, j := w.NextTracked()
+		assert(j >= 1 && j <= 3, "step %d: index %d outside 1..3", i, j)
+		assert(slots[j-1].name == v.name, "index %d doesn't match %s", j, v.name)
+	}
+
+	// nothing selectable: the sentinel
+	_, j, ok := w.NextReady([]bool{false, false, false})
+	assert(!ok && j == 0, "expected sentinel 0, got %d", j)
+
+	_, j, ok = w.NextAllowed(fakeBreaker{true, true, true, true})
+	assert(!ok && j == 0, "expected sentinel 0, got %d", j)
+
+	// breaker sees offset indices: 2 is B
+	b := fakeBreaker{false, false, true, false}
+	for i := 0; i < 20; i++ {
+		v, j, ok := w.NextAllowed(b)
+		assert(ok && j != 2 && v.name != "B", "step %d: open slot B selected", i)
+	}
+
+	// without the option failures report -1
+	w = mustNew(slots)
+	_, j, _ = w.NextReady(nil)
+	assert(j == -1, "expected -1, got %d", j)
+}
+
+func TestLinkAntiAffinity(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 2),
+		wi("B", 1),
+		wi("C", 1),
+		wi("D", 1),
+	}
+
+	// same rack: a pick of i forbids i in b
+	forbid := map[int]int{0: 0, 1: 1, 2: 2, 3: 3}
+
+	coincide := func(a, b *WRR[wItem], n int) int {
+		k := 0
+		for i := 0; i < n; i++ {
+			x, y := a.Next(), b.Next()
+			if x.name == y.name {
+				k++
+			}
+		}
+		return k
+	}
+
+	// unlinked, identical schedulers always coincide
+	a, b := mustNew(slots), mustNew(slots)
+	k := coincide(a, b, 1000)
+	assert(k == 1000, "unlinked: expected 1000 co-occurrences, got %d", k)
+
+	a, b = mustNew(slots), mustNew(slots)
+	LinkAntiAffinity(a, b, forbid)
+	k = coincide(a, b, 1000)
+	assert(k < 50, "linked: expected rare co-occurrences, got %d", k)
+
+	LinkAntiAffinity(a, b, nil)
+	assert(b.anti.Load() == nil, "expected link to be removed")
+}
+
+func TestNextMasked(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	masks := [][]bool{
+		{true, true, true},
+		{true, false, true},
+		{false, true, false},
+		{false, false, true, true},
+	}
+	for _, mask := range masks {
+		for i := 0; i < 50; i++ {
+			v, j, ok := w.NextMasked(mask)
+			assert(ok, "mask %v: expected an allowed slot", mask)
+			assert(mask[j], "mask %v: slot %d not allowed", mask, j)
+			assert(w.tab.Load().slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+		}
+	}
+
+	// a full cycle under one mask keeps the relative weights
+	m := make(map[string]int)
+	for i := 0; i < 700; i++ {
+		v, _, _ := w.NextMasked([]bool{true, false, true})
+		m[v.name]++
+	}
+	assert(m["A"]*2 == m["C"]*5, "A:C expected 5:2, got %d:%d", m["A"], m["C"])
+
+	_, j, ok := w.NextMasked([]bool{false, false, false})
+	assert(!ok && j == -1, "all false: expected no slot, got %d", j)
+
+	_, j, ok = w.NextMasked(nil)
+	assert(!ok && j == -1, "nil mask: expected no slot, got %d", j)
+}
+
+func TestNextHealthy(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	down := map[string]bool{"B": true}
+	healthy := func(v wItem) bool { return !down[v.name] }
+
+	m := make(map[string]int)
+	for i := 0; i < 700; i++ {
+		v, j, ok := w.NextHealthy(healthy)
+		assert(ok, "step %d: expected a healthy item", i)
+		assert(w.tab.Load().slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+		m[v.name]++
+	}
+	assert(m["B"] == 0, "unhealthy B selected %d times", m["B"])
+	assert(m["A"]*2 == m["C"]*5, "A:C expected 5:2, got %d:%d", m["A"], m["C"])
+
+	// recovery needs no recompile
+	delete(down, "B")
+	m = make(map[string]int)
+	for i := 0; i < 100; i++ {
+		v, _, _ := w.NextHealthy(healthy)
+		m[v.name]++
+	}
+	assert(m["B"] == 30, "recovered B: expected 30, got %d", m["B"])
+
+	_, j, ok := w.NextHealthy(func(wItem) bool { return false })
+	assert(!ok && j == -1, "all unhealthy: expected no item, got %d", j)
+}
+
+func TestNextNoRepeat(t *testing.T) {
+	assert := newAsserter(t)
+
+	// A is picked back to back by the smooth schedule
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 1),
+		wi("C", 1),
+	})
+
+	m := make(map[string]int)
+	prev := -1
+	for i := 0; i < 1000; i++ {
+		v, j := w.NextNoRepeat()
+		assert(j != prev, "step %d: %s repeated", i, v.name)
+		prev = j
+		m[v.name]++
+	}
+	// A alternates with the others: at most half the picks
+	assert(m["A"] <= 500, "A: expected at most 500, got %d", m["A"])
+	assert(m["B"] > 0 && m["C"] > 0, "B and C starved: %v", m)
+
+	w = mustNew([]wItem{wi("A", 1)})
+	for i := 0; i < 3; i++ {
+		v, j := w.NextNoRepeat()
+		assert(j == 0 && v.name == "A", "single slot: got %s (%d)", v.name, j)
+	}
+	// one enabled slot: picked without skipping any positions
+	w = mustNew([]wItem{wi("A", 0), wi("B", 3)})
+	for i := 0; i < 3; i++ {
+		v, j := w.NextNoRepeat()
+		assert(j == 1 && v.name == "B", "single enabled slot: got %s (%d)", v.name, j)
+	}
+	assert(w.Position() == 3, "expected 3 positions consumed, got %d", w.Position())
+}
+
+func TestPickFeatures(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	a, i := w.PickFeatures([]byte("user42"), []byte("/api/v1"))
+	for k := 0; k < 10; k++ {
+		b, j := w.PickFeatures([]byte("user42"), []byte("/api/v1"))
+		assert(i == j && a.name == b.name, "unstable mapping: %d vs %d", i, j)
+	}
+
+	// feature boundaries matter
+	n := 0
+	for k := 0; k < 100; k++ {
+		u := []byte(fmt.Sprintf("u%d", k))
+		_, x := w.PickFeatures(u, []byte("ab"), []byte("c"))
+		_, y := w.PickFeatures(u, []byte("a"), []byte("bc"))
+		if x != y {
+			n++
+		}
+	}
+	assert(n > 0, "feature boundaries ignored")
+
+	m := make(map[string]int)
+	for k := 0; k < 100000; k++ {
+		v, _ := w.PickFeatures([]byte(fmt.Sprintf("user%d", k)), []byte("/path"))
+		m[v.name]++
+	}
+	want := map[string]float64{"A": 0.5, "B": 0.3, "C": 0.2}
+	for k, p := range want {
+		f := float64(m[k]) / 100000
+		assert(math.Abs(f-p) < 0.01, "%s: expected share %v, got %v", k, p, f)
+	}
+
+	v := w.Next()
+	assert(v.name == "A", "cursor moved: expected A, got %s", v.name)
+}
+
+func TestNextWithPreemptQueue(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, ref := mustNew(slots), mustNew(slots)
+
+	// urgent work for C at every third selection
+	var q []int
+	pq := func() (int, bool) {
+		if len(q) == 0 {
+			return 0, false
+		}
+		j := q[0]
+		q = q[1:]
+		return j, true
+	}
+
+	for i := 0; i < 60; i++ {
+		if i%3 == 0 {
+			q = append(q, 2)
+		}
+
+		v, j := w.NextWithPreemptQueue(pq)
+		assert(slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+		if i%3 == 0 {
+			assert(j == 2, "step %d: expected preempted C, got %s", i, v.name)
+			continue
+		}
+
+		// the smooth sequence continues as if uninterrupted
+		x := ref.Next()
+		assert(v.name == x.name, "step %d: expected %s, got %s", i, x.name, v.name)
+	}
+	assert(w.Position() == 40, "expected 40 smooth picks, got %d", w.Position())
+
+	// a bad index falls back to the smooth pick
+	v, _ := w.NextWithPreemptQueue(func() (int, bool) { return 7, true })
+	x := ref.Next()
+	assert(v.name == x.name, "bad index: expected %s, got %s", x.name, v.name)
+
+	// so does a disabled slot, which isn't counted
+	w, err := New([]wItem{wi("A", 1), wi("B", 0)}, WithStats())
+	assert(err == nil, "new: %v", err)
+	v, j := w.NextWithPreemptQueue(func() (int, bool) { return 1, true })
+	assert(j == 0 && v.name == "A", "disabled slot: expected A, got %s", v.name)
+	assert(slices.Equal(w.Stats(), []uint64{1, 0}), "expected stats {1,0}, got %v", w.Stats())
+
+	// with a sentinel the preempting index is offset like the result
+	w, err = New(slots, WithSentinelZero())
+	assert(err == nil, "new: %v", err)
+	_, j = w.NextWithPreemptQueue(func() (int, bool) { return 0, false })
+	v, k := w.NextWithPreemptQueue(func() (int, bool) { return j, true })
+	assert(k == j && slots[k-1].name == v.name, "sentinel: expected index %d, got %d (%s)", j, k, v.name)
+	pos := w.Position()
+	w.NextWithPreemptQueue(func() (int, bool) { return 0, true })
+	assert(w.Position() == pos+1, "sentinel: index 0 should fall back to the smooth pick")
+}
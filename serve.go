@@ -0,0 +1,63 @@
+// serve.go - WRR as a pipeline stage
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"context"
+)
+
+// Assignment is a request tagged with the item selected for it
+type Assignment[R, T any] struct {
+	Request R
+	Item    T
+
+	// index of Item in the original input order
+	Index int
+}
+
+// Serve assigns each request read from 'in' the next item selected
+// by w.Next() and sends the assignment to 'out', in order. It
+// returns nil once 'in' is closed and every assignment has been
+// sent, or ctx.Err() if the context is cancelled first; a request
+// read but not yet sent is dropped on cancellation. 'out' is not
+// closed.
+func Serve[R, T any](ctx context.Context, w *WRR[T], in <-chan R, out chan<- Assignment[R, T]) error {
+	for {
+		var r R
+		var ok bool
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok = <-in:
+			if !ok {
+				return nil
+			}
+		}
+
+		t, j := w.pick()
+		a := Assignment[R, T]{
+			Request: r,
+			Item:    t.slots[j],
+			Index:   w.ext(j),
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case out <- a:
+		}
+	}
+}
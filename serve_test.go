@@ -0,0 +1,76 @@
+// serve_test.go - tests for the pipeline adapter
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"context"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	in := make(chan int)
+	out := make(chan Assignment[int, wItem], 10)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(context.Background(), w, in, out)
+	}()
+
+	go func() {
+		for i := 0; i < 1000; i++ {
+			in <- i
+		}
+		close(in)
+	}()
+
+	m := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		a := <-out
+		assert(a.Request == i, "out of order: expected %d, got %d", i, a.Request)
+		assert(w.tab.Load().slots[a.Index].name == a.Item.name, "index %d doesn't match %s", a.Index, a.Item.name)
+		m[a.Item.name]++
+	}
+	assert(m["A"] == 500, "A: expected 500, got %d", m["A"])
+	assert(m["B"] == 300, "B: expected 300, got %d", m["B"])
+	assert(m["C"] == 200, "C: expected 200, got %d", m["C"])
+
+	err := <-errc
+	assert(err == nil, "closed input: expected nil, got %v", err)
+}
+
+func TestServeCancel(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{wi("A", 1)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan int, 1)
+	out := make(chan Assignment[int, wItem]) // never read
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Serve(ctx, w, in, out)
+	}()
+
+	// blocked sending the assignment
+	in <- 1
+	cancel()
+	err := <-errc
+	assert(err == context.Canceled, "expected context.Canceled, got %v", err)
+}
@@ -0,0 +1,87 @@
+// session.go - sticky sessions over a WRR schedule
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"sync"
+	"time"
+)
+
+// sessions maps a session id to its sticky slot
+type sessions struct {
+	sync.Mutex
+
+	m     map[string]session
+	swept int // size of the map after the last sweep
+
+	// for tests
+	now func() time.Time
+}
+
+type session struct {
+	slot   int
+	expire time.Time
+}
+
+// PickSession returns the sticky item for 'sessionID' and its index
+// in the original input order. The first call for a session selects
+// the next item in the smooth weighted sequence and pins the session
+// to it for 'ttl'; later calls within the ttl return the same item
+// without moving the cursor. Once the ttl expires the session is
+// re-selected and pinned again. The ttl is not extended by use.
+//
+// Expired sessions are swept periodically as new ones are added.
+func (w *WRR[T]) PickSession(sessionID string, ttl time.Duration) (T, int) {
+	s := &w.sess
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.m == nil {
+		s.m = make(map[string]session)
+		if s.now == nil {
+			s.now = time.Now
+		}
+	}
+
+	now := s.now()
+	t := w.tab.Load()
+	if e, ok := s.m[sessionID]; ok && now.Before(e.expire) && e.slot < len(t.slots) {
+		return t.slots[e.slot], w.ext(e.slot)
+	}
+
+	t, c := w.advance(1)
+	j := t.at(c)
+	t.count(j)
+
+	s.m[sessionID] = session{
+		slot:   j,
+		expire: now.Add(ttl),
+	}
+	if n := len(s.m); n >= 64 && n >= 2*s.swept {
+		s.sweep(now)
+	}
+	return t.slots[j], w.ext(j)
+}
+
+// sweep removes the expired sessions
+func (s *sessions) sweep(now time.Time) {
+	for k, e := range s.m {
+		if !now.Before(e.expire) {
+			delete(s.m, k)
+		}
+	}
+	s.swept = len(s.m)
+}
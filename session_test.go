@@ -0,0 +1,60 @@
+// session_test.go - tests for sticky sessions
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPickSession(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+		wi("C", 1),
+	})
+
+	now := time.Unix(1000, 0)
+	w.sess.now = func() time.Time { return now }
+
+	ttl := 10 * time.Second
+	_, j := w.PickSession("s1", ttl)
+	for i := 0; i < 9; i++ {
+		now = now.Add(time.Second)
+		_, k := w.PickSession("s1", ttl)
+		assert(j == k, "t+%ds: session moved from %d to %d", i+1, j, k)
+	}
+
+	// other sessions advance the cursor
+	_, k := w.PickSession("s2", ttl)
+	assert(j != k, "s2: expected a different slot than %d", j)
+
+	// expired: re-selected
+	now = now.Add(time.Second)
+	_, k = w.PickSession("s1", ttl)
+	assert(j != k, "expired session still on slot %d", j)
+
+	// sweep drops expired sessions
+	for i := 0; i < 100; i++ {
+		w.PickSession(fmt.Sprintf("x%d", i), time.Millisecond)
+	}
+	now = now.Add(time.Second)
+	for i := 0; i < 100; i++ {
+		w.PickSession(fmt.Sprintf("y%d", i), ttl)
+	}
+	n := len(w.sess.m)
+	assert(n < 200, "expected expired sessions to be swept, have %d", n)
+}
@@ -0,0 +1,90 @@
+// state.go - saving and restoring the runtime state of a WRR
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// state is the serialized form of a scheduler
+type state struct {
+	Weights []int    `json:"weights"`
+	Cursor  uint64   `json:"cursor"`
+	Stats   []uint64 `json:"stats,omitempty"`
+}
+
+// DumpState serializes the runtime state of the scheduler as JSON:
+// the configured weights, the cursor and, if WithStats() is set, the
+// per-slot selection counts. The items themselves are not included.
+// Selections racing with DumpState() may or may not be reflected.
+func (w *WRR[T]) DumpState() ([]byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	s := state{
+		Weights: t.wts,
+		Cursor:  w.next.Load(),
+		Stats:   w.Stats(),
+	}
+	return json.Marshal(&s)
+}
+
+// LoadState restores a state saved by DumpState(), e.g., across a
+// restart: the weights are recompiled for the current items, and the
+// cursor and counts are restored as saved. The weights must be valid
+// for the scheduler's items and options. Saved counts are ignored
+// unless the scheduler was constructed with WithStats(). A pending
+// ScheduleWeightChange() is cancelled. On error the scheduler is
+// unchanged.
+func (w *WRR[T]) LoadState(b []byte) error {
+	var s state
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("wrr: load state: %w", err)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if len(s.Weights) != len(t.slots) {
+		return fmt.Errorf("wrr: load state: %d weights for %d slots", len(s.Weights), len(t.slots))
+	}
+	if t.stats != nil && s.Stats != nil && len(s.Stats) != len(t.stats) {
+		return fmt.Errorf("wrr: load state: %d counts for %d slots", len(s.Stats), len(t.stats))
+	}
+
+	nt, err := w.compileFor(t, s.Weights)
+	if err != nil {
+		return err
+	}
+
+	if nt.stats != nil {
+		for i := range nt.stats {
+			var v uint64
+			if s.Stats != nil {
+				v = s.Stats[i]
+			}
+			nt.stats[i].Store(v)
+		}
+	}
+
+	w.pending.Store(nil)
+	w.tab.Store(nt)
+	w.next.Store(s.Cursor)
+	return nil
+}
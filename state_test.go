@@ -0,0 +1,74 @@
+// state_test.go - tests for saving and restoring state
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestDumpLoadState(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithStats())
+	assert(err == nil, "new: %v", err)
+	for i := 0; i < 17; i++ {
+		w.Next()
+	}
+	err = w.PenalizeErrors([]int{0, 0, 1}, 1)
+	assert(err == nil, "penalize: %v", err)
+	for i := 0; i < 4; i++ {
+		w.Next()
+	}
+
+	b, err := w.DumpState()
+	assert(err == nil, "dump: %v", err)
+
+	// a fresh scheduler picks up where w left off
+	r, err := New(slots, WithStats())
+	assert(err == nil, "new: %v", err)
+	err = r.LoadState(b)
+	assert(err == nil, "load: %v", err)
+
+	assert(r.next.Load() == w.next.Load(), "cursor: expected %d, got %d", w.next.Load(), r.next.Load())
+	assert(slices.Equal(r.Weights(), w.Weights()), "weights: expected %v, got %v", w.Weights(), r.Weights())
+	assert(slices.Equal(r.Stats(), w.Stats()), "stats: expected %v, got %v", w.Stats(), r.Stats())
+	for i := 0; i < 50; i++ {
+		x, y := w.Next(), r.Next()
+		assert(x.name == y.name, "step %d: expected %s, got %s", i, x.name, y.name)
+	}
+
+	// counts are ignored without stats
+	r = mustNew(slots)
+	err = r.LoadState(b)
+	assert(err == nil, "load: %v", err)
+	assert(r.Stats() == nil, "expected no stats")
+
+	// weights must fit the items
+	r = mustNew(slots[:2])
+	err = r.LoadState(b)
+	assert(err != nil, "expected weight count mismatch error")
+
+	err = r.LoadState([]byte(`{"weights":[1,-1],"cursor":3}`))
+	assert(err != nil, "expected bad weight error")
+	assert(r.next.Load() == 0, "failed load changed the cursor")
+
+	err = r.LoadState([]byte(`{`))
+	assert(err != nil, "expected json error")
+}
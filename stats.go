@@ -0,0 +1,267 @@
+// stats.go - per-slot selection statistics
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+)
+
+// Returns the next item in the smooth weighted sequence and its
+// index in the original input order; it is Next() and NextIndex() in
+// one call, and selects exactly as they do, including WithSharding()
+// and LinkAntiAffinity(). Like every selection it is counted when the
+// scheduler was constructed with WithStats(): Next() is no slower a
+// way to keep per-slot counts.
+func (w *WRR[T]) NextTracked() (T, int) {
+	t, j := w.pick()
+	return t.slots[j], w.ext(j)
+}
+
+// Stats returns a snapshot of the number of times each slot was
+// selected, in the original input order. Returns nil unless the
+// scheduler was constructed with WithStats().
+func (w *WRR[T]) Stats() []uint64 {
+	t := w.tab.Load()
+	if t.stats == nil {
+		return nil
+	}
+
+	v := make([]uint64, len(t.stats))
+	for i := range t.stats {
+		v[i] = t.stats[i].Load()
+	}
+	return v
+}
+
+// Rotate drains the per-slot selection counts, returning them in
+// the original input order and leaving every counter at zero. Each
+// selection is counted in exactly one interval, even when selections
+// race with Rotate(): successive rotations partition the selections
+// made. Returns nil for the counts unless the scheduler was
+// constructed with WithStats().
+//
+// If 'resetCursor' is true the cursor, and every cursor of
+// WithSharding(), is also moved to a cycle boundary so the next
+// interval begins at the start of the cycle. Cursors are moved
+// forward to the next boundary, never back, so a change queued with
+// ScheduleWeightChange() still applies at its absolute count; the
+// positions skipped count towards it.
+func (w *WRR[T]) Rotate(resetCursor bool) []uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if resetCursor {
+		n := uint64(t.size())
+		toBoundary(&w.next, n)
+		for i := range w.shards {
+			toBoundary(&w.shards[i].Uint64, n)
+		}
+	}
+	if t.stats == nil {
+		return nil
+	}
+
+	v := make([]uint64, len(t.stats))
+	for i := range t.stats {
+		v[i] = t.stats[i].Swap(0)
+	}
+	return v
+}
+
+// toBoundary moves the cursor 'c' forward to the next multiple of the
+// cycle length n unless it is at one.
+func toBoundary(c *atomic.Uint64, n uint64) {
+	for {
+		v := c.Load()
+		r := v % n
+		if r == 0 || c.CompareAndSwap(v, v-r+n) {
+			return
+		}
+	}
+}
+
+// KLDivergence returns the Kullback-Leibler divergence (in nats)
+// of the realized selection shares from the configured shares of
+// the schedule. Values near zero mean selections are on target.
+// Slots that were never selected contribute nothing. Slots of
+// weight 0 are left out along with their counts, e.g., those of a
+// slot from before it was drained, so the realized shares are over
+// the enabled slots only. Returns 0 if stats aren't enabled or no
+// enabled slot was selected yet.
+func (w *WRR[T]) KLDivergence() float64 {
+	t := w.tab.Load()
+	if t.stats == nil {
+		return 0
+	}
+
+	counts := make([]uint64, len(t.stats))
+	var tot uint64
+	for i := range t.stats {
+		if t.eff[i] > 0 {
+			counts[i] = t.stats[i].Load()
+			tot += counts[i]
+		}
+	}
+	if tot == 0 {
+		return 0
+	}
+
+	var d float64
+	n := float64(t.size())
+	for i, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(tot)
+		q := float64(t.eff[i]) / n
+		d += p * math.Log(p/q)
+	}
+	return d
+}
+
+// Report returns a human readable table with one row per slot in the
+// original input order: the index, the configured weight, the
+// configured share of selections, the realized share so far and the
+// largest number of other selections between two selections of the
+// slot in a cycle. The realized share requires WithStats(); without
+// it the column shows "-".
+func (w *WRR[T]) Report() string {
+	t := w.tab.Load()
+
+	var tot int
+	for _, v := range t.wts {
+		tot += v
+	}
+
+	var done uint64
+	for i := range t.stats {
+		done += t.stats[i].Load()
+	}
+
+	gaps := t.maxGaps(len(t.slots))
+
+	var b strings.Builder
+	tw := tabwriter.NewWriter(&b, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "index\tweight\tshare\trealized\tmax gap\t\n")
+	for i, v := range t.wts {
+		rs := "-"
+		if t.stats != nil {
+			var r float64
+			if done > 0 {
+				r = float64(t.stats[i].Load()) / float64(done)
+			}
+			rs = fmt.Sprintf("%.4f", r)
+		}
+		fmt.Fprintf(tw, "%d\t%d\t%.4f\t%s\t%d\t\n",
+			w.ext(i), v, float64(v)/float64(tot), rs, gaps[i])
+	}
+	tw.Flush()
+	return b.String()
+}
+
+// dumpMax is the number of items String() prints before eliding
+// the rest of the cycle.
+const dumpMax = 64
+
+// String returns a one line debug dump of the compiled schedule:
+// the number of slots, the cycle length after gcd reduction and the
+// items of one full cycle, from its first position, each formatted
+// with %v. E.g., for the weights {A:3, B:1}:
+//
+//	2 slots, cycle of 4: A A B A
+//
+// Cycles longer than 64 entries are cut short with an ellipsis.
+// The cursor is not used or moved.
+func (w *WRR[T]) String() string {
+	t := w.tab.Load()
+	sz := t.size()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d slots, cycle of %d:", len(t.slots), sz)
+	for i := range min(sz, dumpMax) {
+		fmt.Fprintf(&b, " %v", t.slots[t.at(uint64(i))])
+	}
+	if sz > dumpMax {
+		fmt.Fprintf(&b, " ... (%d more)", sz-dumpMax)
+	}
+	return b.String()
+}
+
+// History returns the indices, in the original input order, of the
+// most recent selections recorded with WithHistory(), oldest first
+// and most recent last; at most k of them. Returns nil unless the
+// scheduler was constructed with WithHistory(). Selections racing
+// with History() may or may not be reflected.
+func (w *WRR[T]) History() []int {
+	h := w.tab.Load().hist
+	if h == nil {
+		return nil
+	}
+
+	k := uint64(len(h.buf))
+	n := h.n.Load()
+	start := n - min(n, k)
+
+	v := make([]int, 0, n-start)
+	for i := start; i < n; i++ {
+		v = append(v, w.ext(int(h.buf[i%k].Load())))
+	}
+	return v
+}
+
+// history is a ring of the most recently selected slot indices
+type history struct {
+	buf []atomic.Int64
+	n   atomic.Uint64 // selections recorded
+}
+
+// record adds slot j to the ring
+func (h *history) record(j int) {
+	i := h.n.Add(1) - 1
+	h.buf[i%uint64(len(h.buf))].Store(int64(j))
+}
+
+// remap returns a copy of the ring with every slot k renumbered to
+// to(k); the slots for which to(k) < 0 are dropped.
+func (h *history) remap(to func(int64) int64) *history {
+	nh := &history{
+		buf: make([]atomic.Int64, len(h.buf)),
+	}
+
+	k := uint64(len(h.buf))
+	n := h.n.Load()
+	for i := n - min(n, k); i < n; i++ {
+		if j := to(h.buf[i%k].Load()); j >= 0 {
+			nh.record(int(j))
+		}
+	}
+	return nh
+}
+
+// count records a selection of slot j when stats or history are
+// enabled
+func (t *table[T]) count(j int) {
+	if t.stats != nil {
+		t.stats[j].Add(1)
+	}
+	if t.hist != nil {
+		t.hist.record(j)
+	}
+}
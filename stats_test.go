@@ -0,0 +1,287 @@
+// stats_test.go - tests for selection statistics
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNextTracked(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithStats())
+	assert(err == nil, "new: %v", err)
+
+	for i := 0; i < 1000; i++ {
+		v, j := w.NextTracked()
+		assert(slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+	}
+
+	st := w.Stats()
+	assert(st[0] == 500, "A: expected 500, got %d", st[0])
+	assert(st[1] == 300, "B: expected 300, got %d", st[1])
+	assert(st[2] == 200, "C: expected 200, got %d", st[2])
+
+	// plain Next() is counted too
+	w.Next()
+	st = w.Stats()
+	assert(st[0]+st[1]+st[2] == 1001, "expected 1001 selections, got %v", st)
+
+	w = mustNew(slots)
+	w.NextTracked()
+	assert(w.Stats() == nil, "expected no stats without WithStats")
+
+	// it selects like Next(), anti-affinity included
+	a := mustNew([]wItem{wi("X", 1)})
+	x, y := mustNew(slots), mustNew(slots)
+	for _, b := range []*WRR[wItem]{x, y} {
+		LinkAntiAffinity(a, b, map[int]int{0: 0})
+	}
+	a.Next()
+	for i := 0; i < 100; i++ {
+		v, _ := x.NextTracked()
+		assert(v.name == y.Next().name, "step %d: diverged from Next()", i)
+	}
+}
+
+func TestKLDivergence(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithStats())
+	assert(err == nil, "new: %v", err)
+	assert(w.KLDivergence() == 0, "expected 0 before any selection")
+
+	// full cycle: on target
+	tally(w, 10)
+	d := w.KLDivergence()
+	assert(math.Abs(d) < 1e-9, "full cycle: expected ~0, got %v", d)
+
+	// partial cycle: off target
+	tally(w, 1)
+	d = w.KLDivergence()
+	assert(d > 1e-6, "partial cycle: expected > 0, got %v", d)
+
+	// a drained slot with counts is left out
+	err = w.UpdateWeights([]int{5, 3, 0})
+	assert(err == nil, "update: %v", err)
+	w.Reset()
+	tally(w, 8)
+	d = w.KLDivergence()
+	assert(!math.IsInf(d, 0) && !math.IsNaN(d), "drained slot: expected a finite value, got %v", d)
+	assert(d > 1e-6, "drained slot: expected > 0, got %v", d)
+
+	w, err = New(slots[:2], WithStats())
+	assert(err == nil, "new: %v", err)
+	tally(w, 8)
+	err = w.UpdateWeights([]int{1, 0})
+	assert(err == nil, "update: %v", err)
+	tally(w, 8)
+	d = w.KLDivergence()
+	assert(d == 0, "only A enabled: expected 0, got %v", d)
+
+	w = mustNew(slots)
+	tally(w, 10)
+	assert(w.KLDivergence() == 0, "expected 0 without stats")
+}
+
+func TestReport(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithStats())
+	assert(err == nil, "new: %v", err)
+	for i := 0; i < 100; i++ {
+		w.Next()
+	}
+
+	r := w.Report()
+	lines := strings.Split(strings.TrimRight(r, "\n"), "\n")
+	assert(len(lines) == 4, "expected header and 3 rows, got:\n%s", r)
+
+	hdr := strings.Fields(lines[0])
+	want := []string{"index", "weight", "share", "realized", "max", "gap"}
+	assert(slices.Equal(hdr, want), "bad header %q", lines[0])
+
+	rows := [][]string{
+		{"0", "5", "0.5000", "0.5000", "2"},
+		{"1", "3", "0.3000", "0.3000", "3"},
+		{"2", "2", "0.2000", "0.2000", "4"},
+	}
+	for i, row := range rows {
+		f := strings.Fields(lines[i+1])
+		assert(slices.Equal(f, row), "row %d: expected %v, got %v", i, row, f)
+	}
+
+	// no stats: realized is blank
+	w = mustNew(slots)
+	lines = strings.Split(strings.TrimRight(w.Report(), "\n"), "\n")
+	f := strings.Fields(lines[1])
+	assert(len(f) == 5 && f[3] == "-", "no stats: expected '-', got %v", f)
+}
+
+func TestString(t *testing.T) {
+	assert := newAsserter(t)
+
+	w, err := NewFromMap(map[string]int{"A": 3, "B": 1})
+	assert(err == nil, "new: %v", err)
+	w.Next()
+
+	want := "2 slots, cycle of 4: A A B A"
+	assert(w.String() == want, "expected %q, got %q", want, w.String())
+	assert(fmt.Sprint(w) == want, "expected %q, got %q", want, fmt.Sprint(w))
+
+	// long cycles are elided
+	w, err = NewFromMap(map[string]int{"A": 99, "B": 1})
+	assert(err == nil, "new: %v", err)
+	s := w.String()
+	f := strings.Fields(s)
+	assert(strings.HasPrefix(s, "2 slots, cycle of 100: A A"), "bad prefix in %q", s)
+	assert(strings.HasSuffix(s, " ... (36 more)"), "bad suffix in %q", s)
+	assert(len(f) == 5+64+3, "expected 64 items, got %q", s)
+}
+
+func TestRotate(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithStats())
+	assert(err == nil, "new: %v", err)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10000; i++ {
+				w.Next()
+			}
+		}()
+	}
+
+	// rotate while selections are in flight
+	var got uint64
+	for i := 0; i < 10; i++ {
+		for _, c := range w.Rotate(true) {
+			got += c
+		}
+	}
+	wg.Wait()
+	for _, c := range w.Rotate(true) {
+		got += c
+	}
+	assert(got == 40000, "rotations: expected 40000 selections, got %d", got)
+
+	for i, c := range w.Stats() {
+		assert(c == 0, "slot %d: expected 0 after rotate, got %d", i, c)
+	}
+
+	// cursor is back at the start of the cycle
+	w.Next()
+	w.Next()
+	w.Rotate(true)
+	v := w.Next()
+	assert(v.name == "A", "expected cycle start A, got %s", v.name)
+
+	// without the reset the cursor carries on
+	w.Rotate(false)
+	v = w.Next()
+	assert(v.name == "B", "expected second pick B, got %s", v.name)
+
+	// the reset moves forward: a scheduled change still applies at
+	// its count
+	w.Reset()
+	err = w.ScheduleWeightChange(12, []int{1, 1, 0})
+	assert(err == nil, "schedule: %v", err)
+	w.NextN(3)
+	w.Rotate(true)
+	assert(w.Position() == 10, "expected cursor at 10, got %d", w.Position())
+	m := tally(w, 2)
+	assert(m["A"]+m["B"]+m["C"] == 2, "unexpected picks %v", m)
+	m = tally(w, 10)
+	assert(m["C"] == 0, "change due at 12 not applied: %v", m)
+
+	// shard cursors are moved too
+	w, err = New(slots, WithStats(), WithSharding(4))
+	assert(err == nil, "new: %v", err)
+	w.NextN(7)
+	w.Rotate(true)
+	for i := range w.shards {
+		c := w.shards[i].Load()
+		assert(c%10 == 0, "shard %d: cursor %d not at a cycle boundary", i, c)
+	}
+
+	w = mustNew(slots)
+	assert(w.Rotate(true) == nil, "expected nil without stats")
+}
+
+func TestHistory(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithHistory(4))
+	assert(err == nil, "new: %v", err)
+	assert(len(w.History()) == 0, "expected empty history, got %v", w.History())
+
+	var picked []int
+	for i := 0; i < 3; i++ {
+		_, j := w.NextTracked()
+		picked = append(picked, j)
+	}
+	assert(slices.Equal(w.History(), picked), "expected %v, got %v", picked, w.History())
+
+	for i := 0; i < 10; i++ {
+		_, j := w.NextTracked()
+		picked = append(picked, j)
+	}
+	want := picked[len(picked)-4:]
+	assert(slices.Equal(w.History(), want), "expected %v, got %v", want, w.History())
+
+	// the ring survives reconfiguration
+	err = w.PenalizeErrors([]int{0, 0, 0}, 1)
+	assert(err == nil, "penalize: %v", err)
+	_, j := w.NextTracked()
+	want = append(want[1:], j)
+	assert(slices.Equal(w.History(), want), "expected %v, got %v", want, w.History())
+
+	w = mustNew(slots)
+	w.Next()
+	assert(w.History() == nil, "expected no history without WithHistory")
+}
@@ -0,0 +1,144 @@
+// stream.go - streaming (non-precompiled) smooth WRR
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Streaming is a smooth weighted round-robin scheduler that runs the
+// credit accumulation on every selection instead of precompiling a
+// table. Next() is O(n) but it needs no table, and its credits can be
+// inspected at any time. Safe for concurrent use.
+type Streaming[T any] struct {
+	sync.Mutex
+
+	slots []T
+	eff   []int // gcd-reduced weights
+	cur   []int // current credits
+	tot   int
+}
+
+// Constructs a new streaming scheduler from the given slots. It
+// produces the same sequence as New() for the same slots; slots of
+// weight 0 are never selected.
+//
+// The input slice is not retained or modified.
+func NewStreaming[T Weighted](slots []T) (*Streaming[T], error) {
+	return newStreaming(slots, make([]int, len(slots)))
+}
+
+// Constructs a new streaming scheduler like NewStreaming() that keeps
+// the credits in the caller's 'scratch' instead of allocating them,
+// e.g., to embed the credits in a larger preallocated structure.
+// 'scratch' must hold at least one entry per slot; the first
+// len(slots) entries are zeroed and retained, and must not be used by
+// the caller while the scheduler is in use. Next() never allocates,
+// with or without scratch.
+//
+// The slots are not retained or modified.
+func NewStreamingWithScratch[T Weighted](slots []T, scratch []int) (*Streaming[T], error) {
+	if len(scratch) < len(slots) {
+		return nil, fmt.Errorf("wrr: scratch of %d credits for %d slots", len(scratch), len(slots))
+	}
+
+	cur := scratch[:len(slots):len(slots)]
+	clear(cur)
+	return newStreaming(slots, cur)
+}
+
+// newStreaming makes a streaming scheduler that keeps its credits in
+// 'cur', which must be zeroed and have len(slots) entries.
+func newStreaming[T Weighted](slots []T, cur []int) (*Streaming[T], error) {
+	n := len(slots)
+	if n == 0 {
+		return nil, fmt.Errorf("wrr: no slots to weight")
+	}
+
+	tot := 0
+	eff := make([]int, n)
+	for i := range slots {
+		w := slots[i].Weight()
+		if w < 0 {
+			return nil, fmt.Errorf("wrr: slot index %d: bad weight %d", i, w)
+		}
+		if tot > math.MaxInt-w {
+			return nil, fmt.Errorf("wrr: slot index %d: total weight overflow", i)
+		}
+		eff[i] = w
+		tot += w
+	}
+	if tot == 0 {
+		return nil, fmt.Errorf("wrr: no slot has a positive weight")
+	}
+
+	eff, tot = normalize(eff, tot)
+	s := &Streaming[T]{
+		slots: make([]T, n),
+		eff:   eff,
+		cur:   cur,
+		tot:   tot,
+	}
+
+	copy(s.slots, slots)
+	return s, nil
+}
+
+// Returns the next item in the smooth weighted sequence.
+func (s *Streaming[T]) Next() T {
+	s.Lock()
+	defer s.Unlock()
+
+	var best int
+	for j := range s.eff {
+		s.cur[j] += s.eff[j]
+		if s.cur[j] > s.cur[best] {
+			best = j
+		}
+	}
+	s.cur[best] -= s.tot
+	return s.slots[best]
+}
+
+// Credits returns a snapshot of the current credit of each slot in
+// the original input order. The slot with the highest credit after
+// adding its weight is selected next.
+func (s *Streaming[T]) Credits() []int {
+	s.Lock()
+	defer s.Unlock()
+
+	c := make([]int, len(s.cur))
+	copy(c, s.cur)
+	return c
+}
+
+// PeekNext returns the item the next call to Next() would select,
+// and its index in the original input order, without changing any
+// credits: the slot with the highest credit once the weights are
+// added. Concurrent calls to Next() may select it first.
+func (s *Streaming[T]) PeekNext() (T, int) {
+	s.Lock()
+	defer s.Unlock()
+
+	var best int
+	for j := range s.eff {
+		if s.cur[j]+s.eff[j] > s.cur[best]+s.eff[best] {
+			best = j
+		}
+	}
+	return s.slots[best], best
+}
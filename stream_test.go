@@ -0,0 +1,143 @@
+// stream_test.go - tests for the streaming scheduler
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestStreamingMatchesCompiled(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w := mustNew(slots)
+	s, err := NewStreaming(slots)
+	assert(err == nil, "streaming: %v", err)
+
+	for i := 0; i < 500; i++ {
+		a := w.Next()
+		b := s.Next()
+		assert(a.name == b.name, "diverged at step %d: %s vs %s", i, a.name, b.name)
+	}
+}
+
+func TestStreamingCredits(t *testing.T) {
+	assert := newAsserter(t)
+	s, err := NewStreaming([]wItem{
+		wi("A", 3),
+		wi("B", 1),
+	})
+	assert(err == nil, "streaming: %v", err)
+
+	// credits after each pick of A A B A; total weight 4
+	want := [][]int{
+		{-1, 1},
+		{-2, 2},
+		{1, -1},
+		{0, 0},
+	}
+
+	c := s.Credits()
+	assert(c[0] == 0 && c[1] == 0, "expected zero credits, got %v", c)
+
+	for i, exp := range want {
+		s.Next()
+		c = s.Credits()
+		assert(c[0] == exp[0] && c[1] == exp[1],
+			"step %d: expected credits %v, got %v", i, exp, c)
+	}
+}
+
+func TestStreamingPeekNext(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+	s, err := NewStreaming(slots)
+	assert(err == nil, "streaming: %v", err)
+
+	for i := 0; i < 50; i++ {
+		c := s.Credits()
+		p, j := s.PeekNext()
+		q, k := s.PeekNext()
+		assert(j == k && p.name == q.name, "step %d: peeks differ %d vs %d", i, j, k)
+		assert(slots[j].name == p.name, "index %d doesn't match %s", j, p.name)
+
+		after := s.Credits()
+		for x := range c {
+			assert(c[x] == after[x], "step %d: peek changed credits %v -> %v", i, c, after)
+		}
+
+		v := s.Next()
+		assert(v.name == p.name, "step %d: peeked %s, next %s", i, p.name, v.name)
+	}
+}
+
+func TestStreamingWithScratch(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	// dirty scratch, larger than needed
+	scratch := []int{7, 7, 7, 7, 7}
+	s, err := NewStreamingWithScratch(slots, scratch)
+	assert(err == nil, "streaming: %v", err)
+
+	w := mustNew(slots)
+	for i := 0; i < 500; i++ {
+		a := w.Next()
+		b := s.Next()
+		assert(a.name == b.name, "diverged at step %d: %s vs %s", i, a.name, b.name)
+	}
+
+	// the credits live in the scratch
+	c := s.Credits()
+	assert(slices.Equal(c, scratch[:3]), "credits %v not in scratch %v", c, scratch)
+	assert(scratch[3] == 7 && scratch[4] == 7, "scratch beyond the slots changed: %v", scratch)
+
+	n := testing.AllocsPerRun(100, func() {
+		s.Next()
+	})
+	assert(n == 0, "expected no allocations, got %v", n)
+
+	_, err = NewStreamingWithScratch(slots, make([]int, 2))
+	assert(err != nil, "expected error for short scratch")
+}
+
+func BenchmarkStreamingNext(b *testing.B) {
+	slots := make([]wItem, 16)
+	for i := range slots {
+		slots[i] = wi("s", i+1)
+	}
+
+	s, err := NewStreamingWithScratch(slots, make([]int, len(slots)))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	for b.Loop() {
+		s.Next()
+	}
+}
@@ -0,0 +1,501 @@
+// update.go - live reconfiguration of a WRR scheduler
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync/atomic"
+)
+
+// PenalizeErrors lowers the weight of each slot in proportion to
+// its error count and recompiles the schedule. For slot i with
+// current weight w[i] and error count e[i] the new weight is:
+//
+//	w'[i] = max(1, floor(w[i] / (1 + sensitivity * e[i])))
+//
+// A slot with no errors keeps its weight and no slot drops below
+// weight 1; a slot of weight 0 stays disabled. A sensitivity of 0
+// leaves the weights unchanged.
+// Penalties compound: each call applies to the weights left by the
+// previous one.
+//
+// 'errorCounts' must have one entry per slot in the original input
+// order.
+func (w *WRR[T]) PenalizeErrors(errorCounts []int, sensitivity float64) error {
+	if sensitivity < 0 || math.IsNaN(sensitivity) || math.IsInf(sensitivity, 0) {
+		return fmt.Errorf("wrr: bad sensitivity %v", sensitivity)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if len(errorCounts) != len(t.wts) {
+		return fmt.Errorf("wrr: %d error counts for %d slots", len(errorCounts), len(t.wts))
+	}
+
+	wts := make([]int, len(t.wts))
+	for i, e := range errorCounts {
+		if e < 0 {
+			return fmt.Errorf("wrr: slot index %d: bad error count %d", i, e)
+		}
+
+		if t.wts[i] == 0 {
+			continue
+		}
+
+		z := float64(t.wts[i]) / (1 + sensitivity*float64(e))
+		wts[i] = max(1, int(z))
+	}
+
+	return w.reweight(t, wts)
+}
+
+// UpdateWeights replaces the weights, one per slot in the original
+// input order, e.g., with new weights from a control plane, and
+// recompiles the schedule. The new table is swapped in atomically:
+// concurrent selections see either the old or the new table, never a
+// mix. The cursor keeps its relative phase: a cursor a third of the
+// way through the old cycle lands a third of the way through the new
+// one. Any pending weight change is cancelled. On error the scheduler
+// is unchanged.
+//
+// The input slice is not retained or modified.
+func (w *WRR[T]) UpdateWeights(weights []int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if len(weights) != len(t.slots) {
+		return fmt.Errorf("wrr: %d weights for %d slots", len(weights), len(t.slots))
+	}
+
+	wts := make([]int, len(weights))
+	copy(wts, weights)
+	return w.reweight(t, wts)
+}
+
+// SetShares sets the weights to the smallest integers whose shares
+// of the total are exactly 'shares', one per slot in the original
+// input order, and recompiles the schedule as UpdateWeights() does;
+// e.g., {0.5, 0.3, 0.2} gives the weights {5, 3, 2}. Each share is
+// matched by the fraction with the smallest denominator within 1e-9
+// of it, so 1/3 written as 0.333333333333 is a third. The shares must
+// be positive and sum to 1 within 1e-6. On error the scheduler is
+// unchanged.
+func (w *WRR[T]) SetShares(shares []float64) error {
+	wts, err := exactShareWeights(shares)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if len(wts) != len(t.slots) {
+		return fmt.Errorf("wrr: %d shares for %d slots", len(wts), len(t.slots))
+	}
+	return w.reweight(t, wts)
+}
+
+// Add appends 'item' with the given weight as a new slot, after the
+// existing ones in the original input order, and recompiles the
+// schedule. As with UpdateWeights() the new table is swapped in
+// atomically and the cursor keeps its relative phase. With
+// WithStats() the new slot starts with a count of 0. On error the
+// scheduler is unchanged.
+func (w *WRR[T]) Add(item T, weight int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	n := len(t.slots)
+
+	slots := make([]T, n+1)
+	copy(slots, t.slots)
+	slots[n] = item
+
+	wts := make([]int, n+1)
+	copy(wts, t.wts)
+	wts[n] = weight
+
+	from := make([]int, n+1)
+	for i := range n {
+		from[i] = i
+	}
+	from[n] = -1
+	return w.resize(t, slots, wts, from)
+}
+
+// CanAdd returns true if a slot of the given weight can be added with
+// Add() without the compiled table exceeding its size limits: the
+// maximum table length (see WithMaxSeqLen()), the build budget (see
+// WithBuildBudget()) and the index width. Other options, e.g.,
+// WithDominanceCheck(), may still make Add() fail. This is cheaper
+// than calling Add() and handling the error: nothing is compiled.
+func (w *WRR[T]) CanAdd(weight int) bool {
+	if weight < 0 {
+		return false
+	}
+
+	t := w.tab.Load()
+	n := len(t.wts) + 1
+
+	g, tot := weight, weight
+	for _, v := range t.wts {
+		if tot > math.MaxInt-v {
+			return false
+		}
+		g = gcd(g, v)
+		tot += v
+	}
+
+	// existing weights are valid so tot > 0
+	tot /= g
+	uni := tot == n && weight > 0 && !slices.Contains(t.wts, 0)
+	return w.opt.index.check(n) == nil &&
+		w.opt.checkSeqLen(tot) == nil &&
+		w.opt.checkBudget(n, tot, uni) == nil
+}
+
+// Remove removes the slot at 'index' (in the original input order)
+// and recompiles the schedule; the slots after it move down by one.
+// As with UpdateWeights() the new table is swapped in atomically, so
+// concurrent selections return either a slot of the old table or
+// one of the new. State kept by slot index follows the slots that
+// move: sessions pinned by PickSession(), the last NextNoRepeat()
+// pick, History() and LinkAntiAffinity(); the sessions, history and
+// forbidden entries for the removed slot are dropped. Removing the
+// only slot, or the last slot of positive weight, is an error. On
+// error the scheduler is unchanged.
+func (w *WRR[T]) Remove(index int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	n := len(t.slots)
+	if index < 0 || index >= n {
+		return fmt.Errorf("wrr: remove: bad slot index %d", index)
+	}
+	if n == 1 {
+		return fmt.Errorf("wrr: remove: can't remove the only slot")
+	}
+
+	slots := make([]T, 0, n-1)
+	wts := make([]int, 0, n-1)
+	from := make([]int, 0, n-1)
+	for i := range n {
+		if i != index {
+			slots = append(slots, t.slots[i])
+			wts = append(wts, t.wts[i])
+			from = append(from, i)
+		}
+	}
+	return w.resize(t, slots, wts, from)
+}
+
+// resize compiles a table over a new set of slots and publishes it;
+// from[i] is the index in 't' of the new slot i, or -1 for a slot
+// that is new. The state kept by slot index is moved to the new
+// indices, and dropped for the slots that are gone. 'slots' and 'wts'
+// are retained. Must be called with w.mu held.
+func (w *WRR[T]) resize(t *table[T], slots []T, wts []int, from []int) error {
+	nt, err := w.compileFor(t, wts)
+	if err != nil {
+		return err
+	}
+
+	nt.slots = slots
+	if t.stats != nil {
+		nt.stats = make([]atomic.Uint64, len(slots))
+		for i, k := range from {
+			if k >= 0 {
+				nt.stats[i].Store(t.stats[k].Load())
+			}
+		}
+	}
+
+	// to[k] is the new index of slot k of 't', or -1 if removed
+	to := make([]int, len(t.slots))
+	for i := range to {
+		to[i] = -1
+	}
+	for i, k := range from {
+		if k >= 0 {
+			to[k] = i
+		}
+	}
+	remap := func(k int64) int64 {
+		if k < 0 || k >= int64(len(to)) {
+			return -1
+		}
+		return int64(to[k])
+	}
+
+	if h := t.hist; h != nil {
+		nt.hist = h.remap(remap)
+	}
+	if t.drained != nil {
+		nt.drained = make([]int, len(slots))
+		for i, k := range from {
+			if k >= 0 {
+				nt.drained[i] = t.drained[k]
+			}
+		}
+	}
+
+	w.renumber(remap)
+
+	w.publish(t, nt)
+	return nil
+}
+
+// renumber moves the state kept by slot index outside the tables,
+// i.e., sessions, anti-affinity and the last picks, from every slot k
+// to remap(k), dropping it where remap(k) < 0; links that name this
+// scheduler's slots as the source end. Must be called with w.mu held.
+func (w *WRR[T]) renumber(remap func(int64) int64) {
+	s := &w.sess
+	s.Lock()
+	for id, e := range s.m {
+		if k := remap(int64(e.slot)); k >= 0 {
+			e.slot = int(k)
+			s.m[id] = e
+		} else {
+			delete(s.m, id)
+		}
+	}
+	s.Unlock()
+
+	if l := w.anti.Load(); l != nil {
+		nl := &antiLink[T]{
+			src:     l.src,
+			forbid:  make(map[int]int, len(l.forbid)),
+			resized: l.resized,
+		}
+		for k, v := range l.forbid {
+			if j := remap(int64(v)); j >= 0 {
+				nl.forbid[k] = int(j)
+			}
+		}
+		if len(nl.forbid) == 0 {
+			nl = nil
+		}
+		w.anti.Store(nl)
+	}
+
+	w.prev.Store(remap(w.prev.Load()-1) + 1)
+	if w.track.Load() {
+		w.last.Store(remap(w.last.Load()))
+	}
+	w.resized.Add(1)
+}
+
+// reweight compiles 'wts' against the slots of 't' and publishes the
+// resulting table. 'wts' is retained. Must be called with w.mu held.
+func (w *WRR[T]) reweight(t *table[T], wts []int) error {
+	nt, err := w.compileFor(t, wts)
+	if err != nil {
+		return err
+	}
+
+	w.publish(t, nt)
+	return nil
+}
+
+// compileFor compiles 'wts' into a new table with the slots of 't'.
+// 'wts' is retained.
+func (w *WRR[T]) compileFor(t *table[T], wts []int) (*table[T], error) {
+	sc, err := w.opt.compile(wts)
+	if err != nil {
+		return nil, err
+	}
+
+	nt := &table[T]{
+		schedule: sc,
+		slots:    t.slots,
+		wts:      wts,
+		stats:    t.stats,
+		hist:     t.hist,
+		epoch:    t.epoch + 1,
+		drained:  t.drained,
+	}
+
+	// remember the weight of the slots being disabled; resize()
+	// renumbers them itself.
+	if len(wts) == len(t.wts) {
+		var copied bool
+		for i, v := range t.wts {
+			if v == 0 || wts[i] != 0 {
+				continue
+			}
+			if !copied {
+				nt.drained = make([]int, len(wts))
+				copy(nt.drained, t.drained)
+				copied = true
+			}
+			nt.drained[i] = v
+		}
+	}
+	return nt, nil
+}
+
+// publish swaps in the new table 'nt' replacing 't' and maps the
+// cursor to the same relative phase of the new cycle: a cursor
+// halfway through the old cycle lands halfway through the new one.
+// Selections that race with the swap may observe either table. Any
+// pending weight change is cancelled. Must be called with w.mu held.
+func (w *WRR[T]) publish(t, nt *table[T]) {
+	oldn, newn := uint64(t.size()), uint64(nt.size())
+
+	pos := w.next.Load() % oldn
+	pos = pos * newn / oldn
+	nt.since, nt.changed = pos, true
+
+	w.pending.Store(nil)
+	w.tab.Store(nt)
+	w.next.Store(pos)
+}
+
+// pendingChange is a compiled table waiting to be swapped in once
+// the cursor reaches 'at'.
+type pendingChange[T any] struct {
+	at   uint64
+	base *table[T] // table the change was compiled against
+	tab  *table[T]
+}
+
+// ScheduleWeightChange queues new weights, one per slot in the
+// original input order, to take effect once the shared cursor
+// reaches the absolute count 'atCount', i.e., after that many
+// selections; this allows pre-programmed traffic shifts. The weights
+// are validated and compiled now; the swap itself happens inside the
+// selection that first reserves position 'atCount' or later, and
+// that selection already uses the new weights. The cursor is not
+// rescaled when the change applies: position 'atCount' maps into the
+// new cycle as atCount % cycle length.
+//
+// 'atCount' must be below 2^63: the cursor is rewound by a multiple
+// of the cycle length once it passes that (see Next()).
+//
+// Only one change can be pending; scheduling another replaces it,
+// and any other reconfiguration cancels it. Concurrent selections
+// racing with the swap may see either table; the swap never blocks
+// selections and is guarded so that it happens exactly once.
+func (w *WRR[T]) ScheduleWeightChange(atCount uint64, weights []int) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	t := w.tab.Load()
+	if len(weights) != len(t.slots) {
+		return fmt.Errorf("wrr: %d weights for %d slots", len(weights), len(t.slots))
+	}
+
+	wts := make([]int, len(weights))
+	copy(wts, weights)
+
+	nt, err := w.compileFor(t, wts)
+	if err != nil {
+		return err
+	}
+
+	w.pending.Store(&pendingChange[T]{
+		at:   atCount,
+		base: t,
+		tab:  nt,
+	})
+	return nil
+}
+
+// applyPending swaps in the pending change 'p' unless another
+// selection already did or the scheduler was reconfigured since.
+// It doesn't take the lock so selections never block: winning the
+// CAS on w.pending makes p.tab ours to finish before it's published.
+func (w *WRR[T]) applyPending(p *pendingChange[T]) {
+	if !w.pending.CompareAndSwap(p, nil) {
+		return
+	}
+
+	p.tab.since, p.tab.changed = p.at, true
+	w.tab.CompareAndSwap(p.base, p.tab)
+}
+
+// PlanUpdate compiles the given weights, one per slot in the original
+// input order, exactly as a reconfiguration would and returns one
+// cycle of the resulting schedule as slot indices. The live
+// scheduler is not modified; this lets tooling review a weight change
+// before it is applied.
+func (w *WRR[T]) PlanUpdate(weights []int) ([]int, error) {
+	t := w.tab.Load()
+	if len(weights) != len(t.slots) {
+		return nil, fmt.Errorf("wrr: %d weights for %d slots", len(weights), len(t.slots))
+	}
+
+	sc, err := w.opt.compile(weights)
+	if err != nil {
+		return nil, err
+	}
+
+	v := make([]int, sc.size())
+	for i := range v {
+		v[i] = w.ext(sc.at(uint64(i)))
+	}
+	return v, nil
+}
+
+// RealizationLag returns the number of selections remaining until a
+// full cycle of selections has been made since the most recent
+// reconfiguration. Any cycle length of consecutive positions holds
+// every slot exactly in proportion to its current weight, wherever it
+// starts, so once this reaches 0 the selections made since the change
+// match the configuration and so should realized metrics. Returns 0
+// if the scheduler was never reconfigured or a full cycle has already
+// been selected.
+func (w *WRR[T]) RealizationLag() int {
+	t := w.tab.Load()
+	if !t.changed {
+		return 0
+	}
+
+	n := uint64(t.size())
+	end := t.since + n
+	c := w.next.Load()
+	if c >= end {
+		return 0
+	}
+
+	// the cursor may have been moved back since, e.g., by Reset()
+	return int(min(end-c, n))
+}
+
+// Epoch returns the configuration epoch: 0 for the configuration the
+// scheduler was constructed with, incremented every time new
+// weights take effect.
+func (w *WRR[T]) Epoch() uint64 {
+	return w.tab.Load().epoch
+}
+
+// NextEpoch is Next() that also returns the index of the item in the
+// original input order and the epoch of the configuration it was
+// selected from. A caller can compare the epoch with Epoch(), or with
+// an epoch seen earlier, to detect a selection from a configuration
+// that has since been replaced and retry.
+func (w *WRR[T]) NextEpoch() (T, int, uint64) {
+	t, j := w.pick()
+	return t.slots[j], w.ext(j), t.epoch
+}
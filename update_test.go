@@ -0,0 +1,490 @@
+// update_test.go - tests for live reconfiguration
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPenalizeErrors(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 5),
+	})
+
+	m := tally(w, 600)
+	assert(m["A"] == 300, "A: expected 300, got %d", m["A"])
+
+	// A: floor(5/(1+0.5*10)) = 0 -> bounded at 1
+	err := w.PenalizeErrors([]int{10, 0}, 0.5)
+	assert(err == nil, "penalize: %v", err)
+
+	wts := w.tab.Load().wts
+	assert(wts[0] == 1 && wts[1] == 5, "expected weights {1,5}, got %v", wts)
+
+	m = tally(w, 600)
+	assert(m["A"] == 100, "A: expected 100, got %d", m["A"])
+	assert(m["B"] == 500, "B: expected 500, got %d", m["B"])
+
+	err = w.PenalizeErrors([]int{1, 2, 3}, 0.5)
+	assert(err != nil, "expected error for count mismatch")
+
+	err = w.PenalizeErrors([]int{0, -1}, 0.5)
+	assert(err != nil, "expected error for negative count")
+
+	err = w.PenalizeErrors([]int{1, 1}, -1)
+	assert(err != nil, "expected error for negative sensitivity")
+}
+
+func TestUpdateWeights(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+		wi("C", 1),
+	})
+
+	// a third of the way through the old cycle
+	w.Next()
+
+	wts := []int{50, 30, 20}
+	err := w.UpdateWeights(wts)
+	assert(err == nil, "update: %v", err)
+	assert(w.Position() == 3, "expected cursor rescaled to 3, got %d", w.Position())
+	assert(w.Epoch() == 1, "expected epoch 1, got %d", w.Epoch())
+
+	wts[0] = 0
+	assert(w.Weights()[0] == 50, "update retained the input slice")
+
+	m := tally(w, 1000)
+	assert(m["A"] == 500, "A: expected 500, got %d", m["A"])
+	assert(m["B"] == 300, "B: expected 300, got %d", m["B"])
+	assert(m["C"] == 200, "C: expected 200, got %d", m["C"])
+
+	err = w.UpdateWeights([]int{1, 2})
+	assert(err != nil, "expected error for weight count mismatch")
+
+	err = w.UpdateWeights([]int{0, 0, 0})
+	assert(err != nil, "expected error for all zero weights")
+	assert(slices.Equal(w.Weights(), []int{50, 30, 20}), "failed update changed weights: %v", w.Weights())
+}
+
+func TestSetShares(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+		wi("C", 1),
+	})
+
+	err := w.SetShares([]float64{0.5, 0.3, 0.2})
+	assert(err == nil, "set shares: %v", err)
+	assert(slices.Equal(w.Weights(), []int{5, 3, 2}), "expected {5,3,2}, got %v", w.Weights())
+
+	err = w.SetShares([]float64{1.0 / 3, 1.0 / 6, 0.5})
+	assert(err == nil, "set shares: %v", err)
+	assert(slices.Equal(w.Weights(), []int{2, 1, 3}), "expected {2,1,3}, got %v", w.Weights())
+
+	err = w.SetShares([]float64{0.125, 0.005, 0.87})
+	assert(err == nil, "set shares: %v", err)
+	assert(slices.Equal(w.Weights(), []int{25, 1, 174}), "expected {25,1,174}, got %v", w.Weights())
+
+	bad := [][]float64{
+		{0.5, 0.3},
+		{0.5, 0.3, 0.1},
+		{0.5, 0.6, -0.1},
+		{0.5, 0.5, math.NaN()},
+		nil,
+	}
+	for _, b := range bad {
+		err = w.SetShares(b)
+		assert(err != nil, "expected error for %v", b)
+	}
+	assert(slices.Equal(w.Weights(), []int{25, 1, 174}), "failed update changed weights: %v", w.Weights())
+}
+
+func TestAddRemove(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+	}, WithStats())
+	assert(err == nil, "new: %v", err)
+
+	m := tally(w, 100)
+	assert(m["A"] == 50 && m["B"] == 50, "before: expected 50/50, got %v", m)
+
+	err = w.Add(wi("C", 8), 8)
+	assert(err == nil, "add: %v", err)
+	assert(w.Len() == 3, "expected 3 slots, got %d", w.Len())
+	assert(slices.Equal(w.Stats(), []uint64{50, 50, 0}), "stats not carried over: %v", w.Stats())
+
+	m = tally(w, 1000)
+	assert(m["A"] == 100 && m["B"] == 100, "after add: expected 100/100, got %v", m)
+	assert(m["C"] == 800, "after add: C expected 800, got %d", m["C"])
+
+	err = w.Remove(0)
+	assert(err == nil, "remove: %v", err)
+	assert(slices.Equal(w.Weights(), []int{1, 8}), "expected weights {1,8}, got %v", w.Weights())
+	assert(slices.Equal(w.Stats(), []uint64{150, 800}), "stats not carried over: %v", w.Stats())
+
+	m = tally(w, 900)
+	assert(m["A"] == 0, "removed slot A selected %d times", m["A"])
+	assert(m["B"] == 100 && m["C"] == 800, "after remove: expected 100/800, got %v", m)
+
+	err = w.Add(wi("D", -1), -1)
+	assert(err != nil, "expected error for bad weight")
+	err = w.Remove(2)
+	assert(err != nil, "expected error for bad index")
+	err = w.Remove(1)
+	assert(err == nil, "remove: %v", err)
+	err = w.Remove(0)
+	assert(err != nil, "expected error removing the only slot")
+
+	z := mustNew([]wItem{wi("A", 0), wi("B", 1)})
+	err = z.Remove(1)
+	assert(err != nil, "expected error removing the last slot of positive weight")
+	assert(z.Len() == 2, "failed remove changed the slots")
+}
+
+func TestRemoveRemapsSlots(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+		wi("C", 1),
+	}, WithHistory(8))
+	assert(err == nil, "new: %v", err)
+
+	now := time.Unix(1000, 0)
+	w.sess.now = func() time.Time { return now }
+
+	// pin sessions to A, B and C
+	ttl := time.Minute
+	pin := make(map[string]string)
+	for i := range 3 {
+		id := fmt.Sprintf("s%d", i)
+		v, _ := w.PickSession(id, ttl)
+		pin[id] = v.name
+	}
+	v, _ := w.NextNoRepeat()
+	assert(v.name == "A", "expected A, got %s", v.name)
+
+	a := mustNew([]wItem{wi("X", 1)})
+	LinkAntiAffinity(a, w, map[int]int{0: 2})
+
+	err = w.Remove(0)
+	assert(err == nil, "remove: %v", err)
+
+	h := w.History()
+	assert(slices.Equal(h, []int{0, 1}), "expected history [0 1], got %v", h)
+	assert(w.prev.Load() == 0, "NextNoRepeat still remembers removed slot A")
+
+	for id, name := range pin {
+		v, j := w.PickSession(id, ttl)
+		if name == "A" {
+			assert(v.name != "A", "%s: removed slot A returned", id)
+			continue
+		}
+		assert(v.name == name, "%s: expected %s, got %s", id, name, v.name)
+		assert(w.tab.Load().slots[j].name == name, "%s: index %d isn't %s", id, j, name)
+	}
+
+	// the forbidden slot C moved to index 1: every pick is B
+	a.Next()
+	for i := range 4 {
+		v := w.Next()
+		assert(v.name == "B", "step %d: forbidden C selected", i)
+	}
+}
+
+func TestAddRemoveConcurrent(t *testing.T) {
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w.Next()
+				w.NextN(3)
+			}
+		}()
+	}
+
+	for i := range 2000 {
+		if err := w.Add(wi("X", i%7+1), i%7+1); err != nil {
+			t.Fatalf("add: %v", err)
+		}
+		if err := w.Remove(0); err != nil {
+			t.Fatalf("remove: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestCanAdd(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 60),
+		wi("B", 30),
+	}, WithMaxSeqLen(100))
+	assert(err == nil, "new: %v", err)
+
+	// {60,30,10} reduces to a table of 10, {60,30,9} to 33 and
+	// {60,30,11} not at all: 101 entries
+	assert(w.CanAdd(10), "expected weight 10 to fit")
+	assert(w.CanAdd(9), "expected weight 9 to fit")
+	assert(w.CanAdd(0), "expected weight 0 to fit")
+	assert(!w.CanAdd(11), "expected weight 11 to exceed the cap")
+	assert(!w.CanAdd(13), "expected weight 13 to exceed the cap")
+	assert(!w.CanAdd(-1), "expected a negative weight to fail")
+	assert(!w.CanAdd(math.MaxInt), "expected an overflowing weight to fail")
+
+	for _, v := range []int{9, 11} {
+		ok := w.CanAdd(v)
+		err := w.Add(wi("C", v), v)
+		assert(ok == (err == nil), "weight %d: CanAdd %v, Add %v", v, ok, err)
+	}
+
+	w, err = New([]wItem{wi("A", 1)}, WithIndexType(Uint8))
+	assert(err == nil, "new: %v", err)
+	for i := 1; i < 256; i++ {
+		err = w.Add(wi("X", 1), 1)
+		assert(err == nil, "add %d: %v", i, err)
+	}
+	assert(!w.CanAdd(1), "expected slot 257 not to fit 8-bit indices")
+}
+
+func TestScheduleWeightChange(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+	})
+
+	err := w.ScheduleWeightChange(10, []int{3, 1})
+	assert(err == nil, "schedule: %v", err)
+
+	m := tally(w, 10)
+	assert(m["A"] == 5 && m["B"] == 5, "before: expected 5/5, got %v", m)
+
+	// from count 10 on: the {3,1} cycle
+	m = tally(w, 400)
+	assert(m["A"] == 300, "after: A expected 300, got %d", m["A"])
+	assert(m["B"] == 100, "after: B expected 100, got %d", m["B"])
+	assert(w.pending.Load() == nil, "change still pending")
+
+	// a count in the past applies on the next selection
+	err = w.ScheduleWeightChange(0, []int{1, 1})
+	assert(err == nil, "schedule: %v", err)
+	m = tally(w, 100)
+	assert(m["A"] == 50 && m["B"] == 50, "past: expected 50/50, got %v", m)
+
+	err = w.ScheduleWeightChange(1000, []int{1, -1})
+	assert(err != nil, "expected error for bad weight")
+
+	err = w.ScheduleWeightChange(1000, []int{1})
+	assert(err != nil, "expected error for weight count mismatch")
+}
+
+func TestPlanUpdate(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 1),
+		wi("B", 1),
+		wi("C", 1),
+	})
+
+	wts := []int{5, 3, 2}
+	plan, err := w.PlanUpdate(wts)
+	assert(err == nil, "plan: %v", err)
+	assert(len(plan) == 10, "expected 10 entries, got %d", len(plan))
+
+	// the live schedule is untouched
+	m := tally(w, 3)
+	assert(m["A"] == 1 && m["B"] == 1 && m["C"] == 1, "live schedule changed: %v", m)
+
+	// apply the same weights and compare
+	err = w.ScheduleWeightChange(0, wts)
+	assert(err == nil, "update: %v", err)
+	w.Next()
+
+	live := w.tab.Load()
+	for i, j := range plan {
+		k := live.at(uint64(i))
+		assert(j == k, "pos %d: planned %d, applied %d", i, j, k)
+	}
+
+	_, err = w.PlanUpdate([]int{1, 2})
+	assert(err != nil, "expected error for weight count mismatch")
+}
+
+func TestRealizationLag(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	assert(w.RealizationLag() == 0, "expected no lag before any change")
+
+	for i := 0; i < 3; i++ {
+		w.Next()
+	}
+
+	// weights 5:3:1; position 3 of 10 maps to 2 of 9, from where
+	// a full cycle of 9 remains
+	err := w.PenalizeErrors([]int{0, 0, 1}, 1)
+	assert(err == nil, "penalize: %v", err)
+
+	n := w.tab.Load().size()
+	lag := w.RealizationLag()
+	assert(lag == n, "expected lag %d, got %d", n, lag)
+
+	m := make(map[string]int)
+	for i := lag; i > 0; i-- {
+		assert(w.RealizationLag() == i, "expected lag %d, got %d", i, w.RealizationLag())
+		m[w.Next().name]++
+	}
+	assert(w.RealizationLag() == 0, "expected lag 0 after the cycle, got %d", w.RealizationLag())
+	assert(m["A"] == 5 && m["B"] == 3 && m["C"] == 1, "expected 5:3:1 since the change, got %v", m)
+
+	// mid-cycle change from {1,1} to {3,1}: a full cycle of 4 remains
+	w = mustNew([]wItem{wi("A", 1), wi("B", 1)})
+	w.Next()
+	err = w.UpdateWeights([]int{3, 1})
+	assert(err == nil, "update: %v", err)
+	assert(w.RealizationLag() == 4, "expected lag 4, got %d", w.RealizationLag())
+	m = tally(w, 4)
+	assert(m["A"] == 3 && m["B"] == 1, "expected 3:1 since the change, got %v", m)
+	assert(w.RealizationLag() == 0, "expected lag 0, got %d", w.RealizationLag())
+
+	// a scheduled change counts from its swap point
+	at := w.next.Load() + 4
+	err = w.ScheduleWeightChange(at, []int{1, 1})
+	assert(err == nil, "schedule: %v", err)
+	for w.next.Load() <= at {
+		w.Next()
+	}
+	lag = w.RealizationLag()
+	assert(uint64(lag) == at+2-w.next.Load(), "scheduled: expected lag %d, got %d", at+2-w.next.Load(), lag)
+}
+
+func TestWeightsSnapshot(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 4),
+		wi("B", 2),
+	})
+
+	cfg := [][]int{{4, 2}, {9, 3}}
+	eff := [][]int{{2, 1}, {3, 1}}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			w.mu.Lock()
+			err := w.reweight(w.tab.Load(), slices.Clone(cfg[i%2]))
+			w.mu.Unlock()
+			if err != nil {
+				t.Errorf("reweight: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 10000; i++ {
+		wts, e := w.Weights(), w.EffectiveWeights()
+		assert(slices.Equal(wts, cfg[0]) || slices.Equal(wts, cfg[1]), "torn weights %v", wts)
+		assert(slices.Equal(e, eff[0]) || slices.Equal(e, eff[1]), "torn effective weights %v", e)
+
+		// the snapshot is a matching pair
+		sw, se := w.WeightsSnapshot()
+		k := slices.IndexFunc(cfg, func(v []int) bool { return slices.Equal(v, sw) })
+		assert(k >= 0, "torn snapshot weights %v", sw)
+		assert(slices.Equal(se, eff[k]), "snapshot pair mismatch: %v with %v", sw, se)
+
+		// callers own the copies
+		wts[0], e[0], sw[0], se[0] = -1, -1, -1, -1
+	}
+	close(done)
+	wg.Wait()
+
+	for _, v := range w.Weights() {
+		assert(v > 0, "copy aliased the table: %v", w.Weights())
+	}
+}
+
+func TestNextEpoch(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	_, _, e := w.NextEpoch()
+	assert(e == 0 && w.Epoch() == 0, "expected epoch 0, got %d", e)
+
+	err := w.PenalizeErrors([]int{0, 0, 1}, 1)
+	assert(err == nil, "penalize: %v", err)
+	_, _, e = w.NextEpoch()
+	assert(e == 1 && w.Epoch() == 1, "expected epoch 1, got %d", e)
+
+	// a failed reconfiguration keeps the epoch
+	err = w.PenalizeErrors([]int{0}, 1)
+	assert(err != nil, "expected error")
+	assert(w.Epoch() == 1, "expected epoch 1, got %d", w.Epoch())
+
+	// a scheduled change counts when it takes effect
+	err = w.ScheduleWeightChange(w.Position()+2, []int{1, 1, 1})
+	assert(err == nil, "schedule: %v", err)
+	_, _, e = w.NextEpoch()
+	assert(e == 1, "before the change: expected epoch 1, got %d", e)
+	w.NextEpoch()
+	_, _, e = w.NextEpoch()
+	assert(e == 2 && w.Epoch() == 2, "after the change: expected epoch 2, got %d", e)
+
+	v, j, _ := w.NextEpoch()
+	assert(w.tab.Load().slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+}
@@ -0,0 +1,363 @@
+// weights.go - deriving integer weights for a WRR schedule
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+
+package wrr
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+)
+
+// WeightsForMaxGap computes integer weights approximating the given
+// shares such that in the compiled schedule no slot waits more than
+// 'maxGap' selections of other slots between two of its own.
+//
+// A slot needs a share of at least 1/(maxGap+1) to meet the bound;
+// lighter slots are raised to that share and the heavier ones give
+// up the difference in proportion to their requested shares. The
+// shares are then scaled to integers, nudging any slot that rounding
+// left short of the bound; the result is reduced by the gcd of the
+// weights.
+//
+// Shares need not sum to 1. Returns an error if the bound can't be
+// met, e.g., when there are more than maxGap+1 slots.
+func WeightsForMaxGap(shares []float64, maxGap int) ([]int, error) {
+	n := len(shares)
+	if n == 0 {
+		return nil, fmt.Errorf("wrr: no shares")
+	}
+	if maxGap < 0 {
+		return nil, fmt.Errorf("wrr: bad max gap %d", maxGap)
+	}
+	if n > maxGap+1 {
+		return nil, fmt.Errorf("wrr: %d slots can't meet max gap %d", n, maxGap)
+	}
+
+	if _, err := sumShares(shares); err != nil {
+		return nil, err
+	}
+
+	// water-fill: raise the light slots to the floor share and scale
+	// the rest down to fit; repeat until no scaled share drops below
+	// the floor.
+	floor := 1 / float64(maxGap+1)
+	want := make([]float64, n)
+	fixed := make([]bool, n)
+	for {
+		rem, free := 1.0, 0.0
+		for i, x := range shares {
+			if fixed[i] {
+				rem -= floor
+			} else {
+				free += x
+			}
+		}
+
+		done := true
+		for i, x := range shares {
+			if fixed[i] {
+				want[i] = floor
+				continue
+			}
+			want[i] = x / free * rem
+			if want[i] < floor {
+				fixed[i] = true
+				done = false
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	// a multiple of maxGap+1 keeps the floor share integral
+	scale := (maxGap + 1) * 1000
+	if scale > maxSeqLen {
+		scale = max(1, maxSeqLen/(maxGap+1)) * (maxGap + 1)
+	}
+
+	wts := make([]int, n)
+	for i, x := range want {
+		z := x * float64(scale)
+		if fixed[i] {
+			z = math.Ceil(z)
+		}
+		wts[i] = max(1, int(math.Round(z)))
+	}
+
+	// rounding can leave a slot just short of the bound; nudge the
+	// offenders up a few times.
+	var o options
+	for range 8 {
+		sc, err := o.compile(wts)
+		if err != nil {
+			return nil, err
+		}
+
+		ok := true
+		for j, g := range sc.maxGaps(n) {
+			if g > maxGap {
+				wts[j] += max(1, wts[j]/100)
+				ok = false
+			}
+		}
+		if ok {
+			return sc.eff, nil
+		}
+	}
+	return nil, fmt.Errorf("wrr: can't find weights for max gap %d", maxGap)
+}
+
+// shareTolerance is how close the rational found for a share must
+// be to it.
+const shareTolerance = 1e-9
+
+// exactShareWeights returns the smallest integer weights whose shares
+// of the total are exactly the rationals closest to 'shares' with a
+// denominator of at most maxSeqLen, e.g., {0.5, 0.3, 0.2} gives
+// {5, 3, 2}. The shares must sum to 1.
+func exactShareWeights(shares []float64) ([]int, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("wrr: no shares")
+	}
+
+	sum, err := sumShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	if math.Abs(sum-1) > 1e-6 {
+		return nil, fmt.Errorf("wrr: shares sum to %v, not 1", sum)
+	}
+
+	num := make([]int, len(shares))
+	den := make([]int, len(shares))
+	lcm := 1
+	for i, x := range shares {
+		p, q, ok := rational(x, maxSeqLen)
+		if !ok {
+			return nil, fmt.Errorf("wrr: slot index %d: no exact weight for share %v", i, x)
+		}
+		num[i], den[i] = p, q
+
+		lcm = lcm / gcd(lcm, q) * q
+		if lcm > maxSeqLen {
+			return nil, fmt.Errorf("wrr: shares need more than %d weight units", maxSeqLen)
+		}
+	}
+
+	for i := range num {
+		num[i] *= lcm / den[i]
+	}
+
+	g := 0
+	for _, v := range num {
+		g = gcd(g, v)
+	}
+	for i := range num {
+		num[i] /= g
+	}
+	return num, nil
+}
+
+// rational returns the fraction p/q with the smallest denominator q,
+// at most maxDen, that is within shareTolerance of x in [0, 1]. It
+// walks the convergents of the continued fraction of x.
+func rational(x float64, maxDen int) (int, int, bool) {
+	h0, h1 := 0, 1
+	k0, k1 := 1, 0
+	r := x
+	for range 64 {
+		a := int(math.Floor(r))
+		if a > maxDen {
+			return 0, 0, false
+		}
+		h0, h1 = h1, a*h1+h0
+		k0, k1 = k1, a*k1+k0
+		if k1 > maxDen {
+			return 0, 0, false
+		}
+		if math.Abs(x-float64(h1)/float64(k1)) <= shareTolerance {
+			return h1, k1, true
+		}
+
+		f := r - float64(a)
+		if f == 0 {
+			break
+		}
+		r = 1 / f
+	}
+	return 0, 0, false
+}
+
+// sumShares validates the float shares 'p' before they are scaled to
+// integer weights and returns their sum. Every share must be finite
+// and positive; e.g., a NaN from a computed metric would otherwise
+// silently turn into an arbitrary weight. The error names the first
+// offending slot.
+func sumShares(p []float64) (float64, error) {
+	var sum float64
+	for i, x := range p {
+		switch {
+		case math.IsNaN(x):
+			return 0, fmt.Errorf("wrr: slot index %d: share is NaN", i)
+		case math.IsInf(x, 0):
+			return 0, fmt.Errorf("wrr: slot index %d: share is infinite", i)
+		case x < 0:
+			return 0, fmt.Errorf("wrr: slot index %d: negative share %v", i, x)
+		case x == 0:
+			return 0, fmt.Errorf("wrr: slot index %d: zero share", i)
+		}
+
+		sum += x
+		if math.IsInf(sum, 0) {
+			return 0, fmt.Errorf("wrr: slot index %d: sum of shares overflows", i)
+		}
+	}
+	return sum, nil
+}
+
+// InferWeights returns integer weights proportional to the observed
+// selection counts, e.g., from Stats(), reduced by their gcd; for
+// counts over whole cycles this recovers the effective weights of
+// the schedule. Slots that were never selected get weight 0. Counts
+// too large for an int after the reduction are scaled down by a
+// power of two, so the result is then only approximately
+// proportional.
+func InferWeights(counts []uint64) []int {
+	var g uint64
+	for _, c := range counts {
+		g = gcd64(g, c)
+	}
+
+	wts := make([]int, len(counts))
+	if g == 0 {
+		return wts
+	}
+
+	var hi uint64
+	for _, c := range counts {
+		hi = max(hi, c/g)
+	}
+
+	var shift uint
+	for hi>>shift > math.MaxInt {
+		shift++
+	}
+	for i, c := range counts {
+		wts[i] = int((c / g) >> shift)
+	}
+	return wts
+}
+
+func gcd64(a, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// SuggestWeights searches for integer weights approximating the given
+// shares whose compiled table has at most 'maxTable' entries. Every
+// table size up to 'maxTable' is tried; the weights for a size are
+// apportioned by largest remainder with every slot getting at least
+// one entry. The weights with the smallest largest share error win,
+// ties going to the smaller table. Returns the weights, reduced by
+// their gcd, and the resulting table size.
+//
+// Shares need not sum to 1.
+func SuggestWeights(raw []float64, maxTable int) ([]int, int, error) {
+	n := len(raw)
+	if n == 0 {
+		return nil, 0, fmt.Errorf("wrr: no shares")
+	}
+	if maxTable < n {
+		return nil, 0, fmt.Errorf("wrr: max table %d too small for %d slots", maxTable, n)
+	}
+
+	sum, err := sumShares(raw)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	p := make([]float64, n)
+	for i, x := range raw {
+		p[i] = x / sum
+	}
+
+	maxTable = min(maxTable, maxSeqLen)
+
+	best := make([]int, n)
+	wts := make([]int, n)
+	ord := make([]int, n)
+	bestErr := math.Inf(1)
+	for tot := n; tot <= maxTable; tot++ {
+		apportion(p, tot, wts, ord)
+
+		var e float64
+		for i, w := range wts {
+			e = max(e, math.Abs(float64(w)/float64(tot)-p[i]))
+		}
+		if e < bestErr {
+			bestErr = e
+			copy(best, wts)
+			if e == 0 {
+				break
+			}
+		}
+	}
+
+	var tot int
+	for _, w := range best {
+		tot += w
+	}
+	best, tot = normalize(best, tot)
+	return best, tot, nil
+}
+
+// apportion distributes 'tot' entries across the shares 'p' by
+// largest remainder, giving every slot at least one, into 'wts'.
+// 'ord' is scratch space of len(p).
+func apportion(p []float64, tot int, wts, ord []int) {
+	sum := 0
+	for i, x := range p {
+		wts[i] = max(1, int(x*float64(tot)))
+		sum += wts[i]
+		ord[i] = i
+	}
+
+	// largest remainder first
+	rem := func(i int) float64 {
+		return p[i]*float64(tot) - float64(wts[i])
+	}
+	slices.SortFunc(ord, func(a, b int) int {
+		return cmp.Compare(rem(b), rem(a))
+	})
+
+	for k := 0; sum < tot; k = (k + 1) % len(ord) {
+		wts[ord[k]]++
+		sum++
+	}
+
+	// the minimum of one may overshoot: take back from the slots
+	// with the smallest remainder that can spare one. tot >= len(p)
+	// so some slot always can.
+	for k := 0; sum > tot; k = (k + 1) % len(ord) {
+		if j := ord[len(ord)-1-k]; wts[j] > 1 {
+			wts[j]--
+			sum--
+		}
+	}
+}
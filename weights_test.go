@@ -0,0 +1,164 @@
+// weights_test.go - tests for weight derivation
+//
+// (c) 2024 Sudhi Herle <sw-at-herle.net>
+//
+// Copyright 2024- Sudhi Herle <sw-at-herle-dot-net>
+// License: BSD-2-Clause
+//
+// If you need a commercial license for this work, please contact
+// the author.
+//
+// This software does not come with any express or implied
+// warranty; it is provided "as is". No claim  is made to its
+// suitability for any purpose.
+package wrr
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestWeightsForMaxGap(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		shares []float64
+		maxGap int
+	}{
+		{[]float64{0.99, 0.01}, 10},
+		{[]float64{0.5, 0.3, 0.2}, 4},
+		{[]float64{0.7, 0.1, 0.1, 0.05, 0.05}, 8},
+		{[]float64{100, 1, 1}, 20},
+		{[]float64{1, 1, 1, 1}, 3},
+	}
+
+	for _, tc := range tests {
+		wts, err := WeightsForMaxGap(tc.shares, tc.maxGap)
+		assert(err == nil, "%v gap %d: %v", tc.shares, tc.maxGap, err)
+
+		sc, err := CompileSequence(wts)
+		assert(err == nil, "%v: compile %v: %v", tc.shares, wts, err)
+
+		s := schedule{seq: sc}
+		for j, g := range s.maxGaps(len(wts)) {
+			assert(g <= tc.maxGap, "%v: weights %v: slot %d gap %d > %d",
+				tc.shares, wts, j, g, tc.maxGap)
+		}
+	}
+
+	// loose bound: shares are kept
+	wts, err := WeightsForMaxGap([]float64{0.5, 0.3, 0.2}, 100)
+	assert(err == nil, "%v", err)
+	assert(wts[0] == 5 && wts[1] == 3 && wts[2] == 2, "expected {5,3,2}, got %v", wts)
+
+	// tight bound: the light slot is raised to 1/11
+	wts, err = WeightsForMaxGap([]float64{0.99, 0.01}, 10)
+	assert(err == nil, "%v", err)
+	assert(wts[0] == 10 && wts[1] == 1, "expected {10,1}, got %v", wts)
+
+	_, err = WeightsForMaxGap([]float64{1, 1, 1}, 1)
+	assert(err != nil, "expected error for infeasible gap")
+
+	_, err = WeightsForMaxGap([]float64{1, -1}, 10)
+	assert(err != nil, "expected error for negative share")
+}
+
+func TestMaxGaps(t *testing.T) {
+	assert := newAsserter(t)
+
+	// {3,1} -> A A B A: B waits 3, A waits at most 1
+	sc, err := CompileSequence([]int{3, 1})
+	assert(err == nil, "%v", err)
+
+	s := schedule{seq: sc}
+	g := s.maxGaps(2)
+	assert(g[0] == 1 && g[1] == 3, "expected gaps {1,3}, got %v", g)
+}
+
+func TestSuggestWeights(t *testing.T) {
+	assert := newAsserter(t)
+
+	// rounded sevenths: 2:3:2 is as close as any table up to 50
+	wts, n, err := SuggestWeights([]float64{0.2857, 0.4286, 0.2857}, 50)
+	assert(err == nil, "%v", err)
+	assert(n == 7, "expected table size 7, got %d (%v)", n, wts)
+	assert(wts[0] == 2 && wts[1] == 3 && wts[2] == 2, "expected {2,3,2}, got %v", wts)
+
+	// irrational shares: the best fit within budget is close
+	raw := []float64{math.Pi, math.E, math.Sqrt2}
+	wts, n, err = SuggestWeights(raw, 100)
+	assert(err == nil, "%v", err)
+	assert(n <= 100, "table size %d > 100", n)
+
+	sum := raw[0] + raw[1] + raw[2]
+	tot := 0
+	for _, w := range wts {
+		tot += w
+	}
+	assert(tot == n, "weights %v don't sum to %d", wts, n)
+	for i, w := range wts {
+		d := math.Abs(float64(w)/float64(n) - raw[i]/sum)
+		assert(d < 0.01, "slot %d: share error %v", i, d)
+	}
+
+	// a tiny share still gets a slot
+	wts, _, err = SuggestWeights([]float64{0.999, 0.001}, 10)
+	assert(err == nil, "%v", err)
+	assert(wts[1] >= 1, "expected light slot to keep a weight, got %v", wts)
+
+	_, _, err = SuggestWeights([]float64{1, 1, 1}, 2)
+	assert(err != nil, "expected error for too small a table")
+
+	_, _, err = SuggestWeights([]float64{1, math.NaN()}, 10)
+	assert(err != nil, "expected error for bad share")
+}
+
+func TestBadShares(t *testing.T) {
+	assert := newAsserter(t)
+
+	bad := []struct {
+		shares []float64
+		msg    string
+	}{
+		{[]float64{1, math.NaN(), 2}, "slot index 1: share is NaN"},
+		{[]float64{math.Inf(1), 1}, "slot index 0: share is infinite"},
+		{[]float64{1, 1, math.Inf(-1)}, "slot index 2: share is infinite"},
+		{[]float64{1, -0.5}, "slot index 1: negative share"},
+		{[]float64{0, 1}, "slot index 0: zero share"},
+		{[]float64{math.MaxFloat64, math.MaxFloat64}, "slot index 1: sum of shares overflows"},
+	}
+
+	for _, b := range bad {
+		_, _, err := SuggestWeights(b.shares, 100)
+		assert(err != nil && strings.Contains(err.Error(), b.msg),
+			"suggest %v: expected %q, got %v", b.shares, b.msg, err)
+
+		_, err = WeightsForMaxGap(b.shares, 10)
+		assert(err != nil && strings.Contains(err.Error(), b.msg),
+			"max gap %v: expected %q, got %v", b.shares, b.msg, err)
+	}
+}
+
+func TestInferWeights(t *testing.T) {
+	assert := newAsserter(t)
+
+	w, err := New([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)}, WithStats())
+	assert(err == nil, "%v", err)
+	for i := 0; i < 70; i++ {
+		w.Next()
+	}
+
+	wts := InferWeights(w.Stats())
+	assert(len(wts) == 3 && wts[0] == 5 && wts[1] == 3 && wts[2] == 2,
+		"expected {5,3,2}, got %v", wts)
+
+	wts = InferWeights([]uint64{0, 40, 60})
+	assert(wts[0] == 0 && wts[1] == 2 && wts[2] == 3, "expected {0,2,3}, got %v", wts)
+
+	wts = InferWeights([]uint64{0, 0})
+	assert(wts[0] == 0 && wts[1] == 0, "expected {0,0}, got %v", wts)
+
+	wts = InferWeights([]uint64{math.MaxUint64, 1})
+	assert(wts[0] > 0 && wts[1] == 0, "expected scaled weights, got %v", wts)
+}
@@ -63,10 +63,22 @@
 package wrr
 
 import (
+	"cmp"
 	"fmt"
+	"iter"
+	"maps"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"slices"
+	"sync"
 	"sync/atomic"
 )
 
+// maxSeqLen is the largest schedule (sum of the gcd-reduced weights)
+// we are willing to compile by default; see WithMaxSeqLen().
+const maxSeqLen = 1 << 20
+
 // Weighted is the constraint for schedulable items.
 type Weighted interface {
 	Weight() int
@@ -74,22 +86,263 @@ type Weighted interface {
 
 // WRR is a precompiled smooth weighted round-robin scheduler.
 // Safe for concurrent use.
-type WRR[T Weighted] struct {
+type WRR[T any] struct {
+	tab  atomic.Pointer[table[T]]
+	next atomic.Uint64
+	opt  options
+
+	// serializes reconfiguration
+	mu sync.Mutex
+
+	// most recently used sub-schedule for NextReady()
+	ready atomic.Pointer[readySet[T]]
+
+	// independent cursors for NextFor()
+	cursors atomic.Pointer[[]*atomic.Uint64]
+
+	// last slot selected by Next(); only recorded when 'track' is
+	// set because another scheduler is anti-affine to this one.
+	last  atomic.Int64
+	track atomic.Bool
+
+	// anti-affinity to another scheduler's last pick
+	anti atomic.Pointer[antiLink[T]]
+
+	// number of times slots were added or removed
+	resized atomic.Uint64
+
+	// weight change to apply at a future cursor position
+	pending atomic.Pointer[pendingChange[T]]
+
+	// slot being re-enabled by EnableWithRamp()
+	ramp atomic.Pointer[ramp[T]]
+
+	// sticky sessions for PickSession()
+	sess sessions
+
+	// external source of cursor positions; see NewClocked()
+	clock func() uint64
+
+	// 1 + slot selected by the last NextNoRepeat(); 0 if none
+	prev atomic.Int64
+
+	// cursors for Next(); nil unless WithSharding() is set
+	shards []shard
+}
+
+// shard is a cursor padded to a cache line of its own
+type shard struct {
+	atomic.Uint64
+	_ [56]byte
+}
+
+// table is a compiled schedule. It is immutable once published;
+// reconfiguration compiles a new table and swaps it in atomically
+// so that selection never blocks and always sees a consistent set
+// of slots, weights and sequence.
+type table[T any] struct {
+	schedule
+
 	slots []T
-	seq   []uint16
-	next  atomic.Uint64
+	wts   []int // configured weights
+
+	// per-slot selection counts; nil unless WithStats() is set.
+	// Shared by tables with the same slots.
+	stats []atomic.Uint64
+
+	// recent selections; nil unless WithHistory() is set. Shared
+	// like stats.
+	hist *history
+
+	// cursor position at which this table replaced an earlier one;
+	// valid only if changed is set.
+	since   uint64
+	changed bool
+
+	// number of reconfigurations before this table
+	epoch uint64
+
+	// weight each slot had before it was last set to 0, for
+	// EnableWithRamp(); nil if no slot was.
+	drained []int
 }
 
 // Constructs a new scheduler from the given slots. Each slot's
 // `Weight()` determines its share of selections. The weight
 // distribution is compiled into a lookup table at construction
-// time.
+// time. A slot of weight 0 is kept but never selected, e.g., to
+// drain it; negative weights, or no slot of positive weight, are
+// an error.
 //
 // The input slice is not retained or modified.
 //
 // Returns a scheduler where `Next()` is O(1) and returns nil
 // on error
-func New[T Weighted](slots []T) (*WRR[T], error) {
+func New[T Weighted](slots []T, opts ...Option) (*WRR[T], error) {
+	wts := make([]int, len(slots))
+	for i := range slots {
+		wts[i] = slots[i].Weight()
+	}
+	return build(slots, wts, opts)
+}
+
+// Constructs a new scheduler like New() that never selects the slots
+// at the indices in 'deny', e.g., to exclude some entries of a fixed
+// catalog. The denied slots are kept with weight 0, so the other
+// slots keep their indices in the original input order and their
+// relative weights, and Weights() records what was excluded. A denied
+// index may be listed more than once; an index out of range, or
+// denying every slot of positive weight, is an error.
+//
+// Neither input slice is retained or modified.
+func NewExcluding[T Weighted](slots []T, deny []int, opts ...Option) (*WRR[T], error) {
+	wts := make([]int, len(slots))
+	for i := range slots {
+		wts[i] = slots[i].Weight()
+	}
+	for _, j := range deny {
+		if j < 0 || j >= len(slots) {
+			return nil, fmt.Errorf("wrr: deny: bad slot index %d", j)
+		}
+		wts[j] = 0
+	}
+	return build(slots, wts, opts)
+}
+
+// BuildInfo describes how the weights of a scheduler were compiled;
+// see NewWithInfo().
+type BuildInfo struct {
+	// sum of the configured weights
+	RawSum int
+
+	// gcd of the configured weights; the table is RawSum/GCD long
+	GCD int
+
+	// entries in the compiled table, i.e., the cycle length
+	TableSize int
+
+	// true if the gcd didn't shrink a large table; rounding the
+	// weights, e.g., with SuggestWeights(), may give a much
+	// smaller table for nearly the same shares.
+	Quantizable bool
+}
+
+// quantizeHint is the table size above which BuildInfo suggests
+// rounding coprime weights.
+const quantizeHint = 1024
+
+// Constructs a new scheduler exactly like New() and also returns
+// advisory information about the compiled table. The information is
+// only valid if the error is nil.
+func NewWithInfo[T Weighted](slots []T, opts ...Option) (*WRR[T], BuildInfo, error) {
+	var bi BuildInfo
+
+	w, err := New(slots, opts...)
+	if err != nil {
+		return nil, bi, err
+	}
+
+	// New() validated the weights and their sum
+	for _, v := range w.tab.Load().wts {
+		bi.RawSum += v
+		bi.GCD = gcd(bi.GCD, v)
+	}
+	bi.TableSize = w.tab.Load().size()
+	bi.Quantizable = bi.GCD == 1 && bi.TableSize > quantizeHint
+	return w, bi, nil
+}
+
+// Constructs a new scheduler from the given items where the weight of
+// each item is weight(item); this is for items that don't implement
+// Weighted, e.g., types from another package. 'weight' is called once
+// per item during construction.
+//
+// The input slice is not retained or modified.
+func NewFunc[T any](items []T, weight func(T) int, opts ...Option) (*WRR[T], error) {
+	wts := make([]int, len(items))
+	for i := range items {
+		wts[i] = weight(items[i])
+	}
+	return build(items, wts, opts)
+}
+
+// Constructs a new scheduler from items weighted along several
+// dimensions, e.g., CPU and memory capacity. weightFns[d] gives the
+// weight of an item in dimension d and dimWeights[d] the importance
+// of that dimension; the weight of item i is the weighted sum:
+//
+//	w(i) = sum over d of dimWeights[d] * weightFns[d](items[i])
+//
+// e.g., with dimWeights {2, 1}, CPU counts twice as much as memory.
+// The per-dimension weights and dimWeights must be non-negative. Each
+// function is called once per item during construction.
+//
+// The input slices are not retained or modified.
+func NewMultiDim[T any](items []T, weightFns []func(T) int, dimWeights []int, opts ...Option) (*WRR[T], error) {
+	if len(weightFns) == 0 {
+		return nil, fmt.Errorf("wrr: no weight dimensions")
+	}
+	if len(weightFns) != len(dimWeights) {
+		return nil, fmt.Errorf("wrr: %d weight functions for %d dimension weights",
+			len(weightFns), len(dimWeights))
+	}
+	for d, k := range dimWeights {
+		if k < 0 {
+			return nil, fmt.Errorf("wrr: dimension %d: negative weight %d", d, k)
+		}
+	}
+
+	wts := make([]int, len(items))
+	for i := range items {
+		for d, fn := range weightFns {
+			v := fn(items[i])
+			if v < 0 {
+				return nil, fmt.Errorf("wrr: slot index %d: dimension %d: negative weight %d", i, d, v)
+			}
+			if v != 0 && dimWeights[d] > (math.MaxInt-wts[i])/v {
+				return nil, fmt.Errorf("wrr: slot index %d: combined weight overflows", i)
+			}
+			wts[i] += dimWeights[d] * v
+		}
+	}
+	return build(items, wts, opts)
+}
+
+// Constructs a new scheduler whose items are the keys of 'm',
+// weighted by their values. The keys are sorted before the schedule
+// is compiled, so schedulers built from equal maps select the keys in
+// the same order regardless of map iteration order; this is why the
+// keys must be ordered rather than just comparable.
+//
+// The map is not retained or modified.
+func NewFromMap[K cmp.Ordered](m map[K]int, opts ...Option) (*WRR[K], error) {
+	keys := slices.Sorted(maps.Keys(m))
+	wts := make([]int, len(keys))
+	for i, k := range keys {
+		wts[i] = m[k]
+	}
+	return build(keys, wts, opts)
+}
+
+// Constructs a new scheduler from a sequence precompiled by
+// CompileSequence(). Each entry of 'seq' is an index into 'slots'
+// and the weight of a slot is the number of times it appears in
+// 'seq'; slots that don't appear have weight 0 and are never
+// selected. This lets one node compile the schedule and distribute it
+// to others that must agree on it.
+//
+// The sequence is adopted as is, so there are two exceptions to
+// schedulers built from weights. The counts are not reduced by their
+// gcd: {0, 0, 1, 1} has weights {2, 2} and a cycle of 4, so GCD() is
+// 2 while TotalWeight() is len(seq), not sum(Weights())/GCD(). And of
+// the options only those that apply to selection take effect, i.e.,
+// WithStats(), WithHistory(), WithSentinelZero() and WithSharding();
+// the options that govern compiling, e.g., WithIndexType() or
+// WithMinRate(), are ignored until the weights are changed, e.g., by
+// UpdateWeights(), which compiles them.
+//
+// Neither input slice is retained or modified.
+func NewFromSequence[T any](slots []T, seq []uint16, opts ...Option) (*WRR[T], error) {
 	n := len(slots)
 
 	if n == 0 {
@@ -99,6 +352,205 @@ func New[T Weighted](slots []T) (*WRR[T], error) {
 		return nil, fmt.Errorf("wrr: too many WRR slots (%d)", n)
 	}
 
+	wts := make([]int, n)
+	for i, j := range seq {
+		if int(j) >= n {
+			return nil, fmt.Errorf("wrr: seq index %d: bad slot %d (%d slots)", i, j, n)
+		}
+		wts[j]++
+	}
+	if len(seq) == 0 {
+		return nil, fmt.Errorf("wrr: no slot has a positive weight")
+	}
+
+	t := &table[T]{
+		schedule: schedule{
+			eff: wts,
+			seq: make([]uint16, len(seq)),
+			cdf: cumulative(wts),
+		},
+		slots: make([]T, n),
+		wts:   wts,
+	}
+
+	copy(t.slots, slots)
+	copy(t.seq, seq)
+	return newWRR(t, makeOptions(opts)), nil
+}
+
+// build compiles 'wts', the weights of the corresponding slots, into
+// a new scheduler. 'wts' is retained and must not be modified by the
+// caller.
+func build[T any](slots []T, wts []int, opts []Option) (*WRR[T], error) {
+	o := makeOptions(opts)
+	sc, err := o.compile(wts)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &table[T]{
+		schedule: sc,
+		slots:    make([]T, len(slots)),
+		wts:      wts,
+	}
+
+	copy(t.slots, slots)
+	return newWRR(t, o), nil
+}
+
+// schedule is one compiled cycle of slot indices. Indices are held
+// in exactly one of narrow, seq or wide depending on their width.
+type schedule struct {
+	eff    []int   // effective weights the cycle was compiled from
+	narrow []uint8 // used instead of seq for 8-bit indices
+	seq    []uint16
+	wide   []uint32 // used instead of seq for 32-bit indices
+
+	// running sum of eff for NextRandom(); nil for sub-schedules
+	cdf []int
+}
+
+// size returns the length of the cycle
+func (s *schedule) size() int {
+	switch {
+	case s.narrow != nil:
+		return len(s.narrow)
+	case s.wide != nil:
+		return len(s.wide)
+	}
+	return len(s.seq)
+}
+
+// single returns true if only one slot has a positive weight
+func (s *schedule) single() bool {
+	var n int
+	for _, e := range s.eff {
+		if e > 0 {
+			if n++; n > 1 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// at returns the slot index at cursor position c
+func (s *schedule) at(c uint64) int {
+	switch {
+	case s.narrow != nil:
+		return lookup(s.narrow, c)
+	case s.wide != nil:
+		return lookup(s.wide, c)
+	}
+	return lookup(s.seq, c)
+}
+
+// lookup returns the entry of the cycle 'v' at cursor position c. A
+// cycle whose length is a power of two is indexed with a mask instead
+// of the much slower modulo.
+func lookup[I index](v []I, c uint64) int {
+	n := uint64(len(v))
+	if n&(n-1) == 0 {
+		return int(v[c&(n-1)])
+	}
+	return int(v[c%n])
+}
+
+// newWRR makes a scheduler around the compiled table 't'
+func newWRR[T any](t *table[T], o options) *WRR[T] {
+	if o.stats {
+		t.stats = make([]atomic.Uint64, len(t.slots))
+	}
+	if o.history > 0 {
+		t.hist = &history{
+			buf: make([]atomic.Int64, o.history),
+		}
+	}
+
+	w := &WRR[T]{
+		opt: o,
+	}
+	if o.shards > 1 {
+		w.shards = make([]shard, o.shards)
+		for i := range w.shards {
+			w.shards[i].Store(uint64(i * t.size() / o.shards))
+		}
+	}
+	w.tab.Store(t)
+	return w
+}
+
+// Clone returns a new scheduler with the same items, weights, compiled
+// schedule and options as w, and its own cursor at the start of the
+// cycle; use SetPosition(w.Position()) to continue from where w is.
+// The compiled table is immutable, so the two share it rather than
+// copying it, and reconfiguring either one leaves the other alone.
+// The clone starts with its own zeroed stats and history, and
+// doesn't inherit sticky sessions, independent cursors, anti-affinity
+// links or a pending weight change. A clocked scheduler's clone
+// shares its clock.
+func (w *WRR[T]) Clone() *WRR[T] {
+	t := w.tab.Load()
+	nt := &table[T]{
+		schedule: t.schedule,
+		slots:    t.slots,
+		wts:      t.wts,
+		epoch:    t.epoch,
+	}
+
+	c := newWRR(nt, w.opt)
+	c.clock = w.clock
+	return c
+}
+
+// CompileSequence compiles the given weights into the smooth weighted
+// lookup table used by the scheduler: each entry is the index of
+// the weight selected at that position of the cycle. The result is
+// deterministic and can be handed to NewFromSequence().
+//
+// The input slice is not retained or modified.
+func CompileSequence(weights []int) ([]uint16, error) {
+	o := options{
+		index: Uint16,
+	}
+
+	sc, err := o.compile(weights)
+	return sc.seq, err
+}
+
+// CompileToArray exports one cycle of the compiled schedule as 16-bit
+// slot indices along with the effective weight of each slot, e.g., to
+// generate static arrays for an embedded target. Slot i appears
+// exactly weights[i] times in the sequence, which can be replayed by
+// indexing it with a counter modulo its length, or handed to
+// NewFromSequence(). Both slices are copies. Returns an error if the
+// slot indices don't fit in 16 bits.
+func (w *WRR[T]) CompileToArray() ([]uint16, []int, error) {
+	t := w.tab.Load()
+	if err := fits[uint16](len(t.slots)); err != nil {
+		return nil, nil, err
+	}
+
+	seq := make([]uint16, t.size())
+	for i := range seq {
+		seq[i] = uint16(t.at(uint64(i)))
+	}
+	return seq, append([]int(nil), t.eff...), nil
+}
+
+// compile validates 'weights' and compiles them into a lookup table
+// subject to the options in 'o'.
+func (o *options) compile(weights []int) (schedule, error) {
+	var sc schedule
+
+	n := len(weights)
+	if n == 0 {
+		return sc, fmt.Errorf("wrr: no slots to weight")
+	}
+	if err := o.index.check(n); err != nil {
+		return sc, err
+	}
+
 	tot := 0
 
 	// single big alloc to reduce gc pressure
@@ -106,21 +558,342 @@ func New[T Weighted](slots []T) (*WRR[T], error) {
 
 	// eff: effective weights (scaled by gcd)
 	eff, cur := blk[:n], blk[n:]
-	for i := range slots {
-		s := slots[i]
-		w := s.Weight()
-		if w <= 0 {
-			return nil, fmt.Errorf("wrr: slot index %d: bad weight %d", i, w)
+	for i, w := range weights {
+		if w < 0 {
+			return sc, fmt.Errorf("wrr: slot index %d: bad weight %d", i, w)
+		}
+		if tot > math.MaxInt-w {
+			return sc, fmt.Errorf("wrr: slot index %d: total weight overflow", i)
 		}
 		eff[i] = w
 		tot += w
 	}
+	if tot == 0 {
+		return sc, fmt.Errorf("wrr: no slot has a positive weight")
+	}
 
 	// Calculate the gcd and scale the weights so we don't have explosion of slots
 	eff, tot = normalize(eff, tot)
+	if err := o.checkSeqLen(tot); err != nil {
+		return sc, err
+	}
+	if err := o.applyFloors(eff); err != nil {
+		return sc, err
+	}
+	if err := o.checkBudget(n, tot, uniform(eff, tot)); err != nil {
+		return sc, err
+	}
+	if err := o.checkDominance(eff, tot); err != nil {
+		return sc, err
+	}
+
+	var err error
+
+	sc.eff = eff
+	sc.cdf = cumulative(eff)
+	switch o.index.bits(n) {
+	case 8:
+		sc.narrow, err = compileWith[uint8](o, eff, cur, tot)
+	case 32:
+		sc.wide, err = compileWith[uint32](o, eff, cur, tot)
+	default:
+		sc.seq, err = compileWith[uint16](o, eff, cur, tot)
+	}
+	return sc, err
+}
+
+// compileWith compiles the normalized weights 'eff' into a table of
+// I using the method selected by the options in 'o'.
+func compileWith[I index](o *options, eff, cur []int, tot int) ([]I, error) {
+	switch {
+	case o.apportion != Smooth:
+		return compileAverages[I](eff, cur, tot, o.apportion)
+	case o.lru:
+		return compileLRU[I](eff, cur, tot)
+	}
+	return compile[I](eff, cur, tot)
+}
+
+// Constructs a new scheduler where the weight of items[i] is
+// weights[i]; this accepts weights as they arrive in a repeated
+// int32 field of a protobuf message. Weights must not be negative.
+//
+// Neither input slice is retained or modified.
+func NewInt32[T any](items []T, weights []int32, opts ...Option) (*WRR[T], error) {
+	if len(weights) != len(items) {
+		return nil, fmt.Errorf("wrr: %d weights for %d items", len(weights), len(items))
+	}
+
+	wts := make([]int, len(weights))
+	for i, v := range weights {
+		if v < 0 {
+			return nil, fmt.Errorf("wrr: slot index %d: bad weight %d", i, v)
+		}
+		wts[i] = int(v)
+	}
+	return build(items, wts, opts)
+}
+
+// Constructs a new scheduler from weights bit-packed 'bits' bits each
+// into 'packed', most significant bit first, in the order of 'items';
+// e.g., with 4 bits, 0x53 holds weights 5 and 3. The final byte is
+// padded with zero bits. 'bits' must be between 1 and 32, 'packed'
+// must hold exactly enough bytes for one weight per item.
+//
+// Neither input slice is retained or modified.
+func NewPacked[T any](items []T, packed []byte, bits int, opts ...Option) (*WRR[T], error) {
+	if bits < 1 || bits > 32 {
+		return nil, fmt.Errorf("wrr: bad packed weight width %d", bits)
+	}
+
+	n := len(items)
+	if want := (n*bits + 7) / 8; len(packed) != want {
+		return nil, fmt.Errorf("wrr: %d packed bytes for %d %d-bit weights (want %d)",
+			len(packed), n, bits, want)
+	}
+
+	wts := make([]int, n)
+	for i := range wts {
+		var v int
+		for b := i * bits; b < (i+1)*bits; b++ {
+			bit := (packed[b/8] >> (7 - b%8)) & 1
+			v = v<<1 | int(bit)
+		}
+		wts[i] = v
+	}
+	return build(items, wts, opts)
+}
+
+// Constructs a new scheduler where the weight of items[i] is
+// base^levels[i]; i.e., each level is 'base' times the weight of
+// the previous level. This is convenient for tiered priorities.
+//
+// Returns an error if a weight overflows or if the resulting
+// schedule is too large. Neither input slice is retained or
+// modified.
+func NewExponential[T any](items []T, levels []int, base int, opts ...Option) (*WRR[T], error) {
+	if len(levels) != len(items) {
+		return nil, fmt.Errorf("wrr: %d levels for %d items", len(levels), len(items))
+	}
+	if base < 1 {
+		return nil, fmt.Errorf("wrr: bad exponent base %d", base)
+	}
+
+	wts := make([]int, len(items))
+	for i, lvl := range levels {
+		if lvl < 0 {
+			return nil, fmt.Errorf("wrr: slot index %d: bad level %d", i, lvl)
+		}
+
+		w := 1
+		for range lvl {
+			if w > math.MaxInt/base {
+				return nil, fmt.Errorf("wrr: slot index %d: weight %d^%d overflows", i, base, lvl)
+			}
+			w *= base
+		}
+		wts[i] = w
+	}
+	return build(items, wts, opts)
+}
+
+// Constructs a new scheduler whose position in the cycle is driven
+// by an external clock rather than by the number of selections:
+// every selection made at clock value c is the item at position c
+// modulo the cycle length. Selections between ticks return the same
+// item and a tick that jumps skips positions. Processes sharing a
+// clock, e.g., one derived from wall time, agree on the selection
+// without coordinating. 'clock' must be safe for concurrent use.
+//
+// The input slice is not retained or modified.
+func NewClocked[T Weighted](slots []T, clock func() uint64, opts ...Option) (*WRR[T], error) {
+	if clock == nil {
+		return nil, fmt.Errorf("wrr: nil clock")
+	}
+
+	w, err := New(slots, opts...)
+	if err != nil {
+		return nil, err
+	}
+	w.clock = clock
+	return w, nil
+}
+
+// Returns the next item in the smooth weighted sequence.
+// Cycles deterministically in O(1) and is concurrency-safe. The
+// cycle continues seamlessly however many selections are made.
+func (w *WRR[T]) Next() T {
+	t, j := w.pick()
+	return t.slots[j]
+}
+
+// NextIndex is Next() that returns the index of the selected item in
+// the original input order instead of the item, e.g., to index
+// per-slot state kept by the caller. It shares the cursor with
+// Next(): the two advance through the same sequence.
+func (w *WRR[T]) NextIndex() int {
+	_, j := w.pick()
+	return w.ext(j)
+}
+
+// Peek returns the item Next() would return at the current cursor
+// position without advancing the cursor or counting a selection; in
+// a single goroutine repeated calls return the same item and the
+// following Next() returns it as well. With concurrent callers the
+// cursor may move between Peek() and Next(), so the item peeked is
+// only a hint of what a later Next() returns. Anti-affinity (see
+// LinkAntiAffinity()) is not applied. With WithSharding() this is the
+// item at the shared cursor, which Next() doesn't use.
+func (w *WRR[T]) Peek() T {
+	var c uint64
+	if w.clock != nil {
+		c = w.clock()
+	} else {
+		c = w.next.Load()
+	}
+
+	t := w.tab.Load()
+	if p := w.pending.Load(); p != nil && c+1 > p.at && p.base == t {
+		t = p.tab
+	}
+	return t.slots[t.at(c)]
+}
+
+// Upcoming returns the next 'n' items in the smooth weighted sequence,
+// i.e., what n calls to Next() would return, without advancing the
+// cursor or counting a selection; e.g., for a preview. A pending
+// weight change is reflected from the position it is due at. Like
+// Peek() this is only a hint with concurrent callers, and with
+// WithSharding() it previews the shared cursor, not Next(). Returns
+// nil if n <= 0.
+func (w *WRR[T]) Upcoming(n int) []T {
+	if n <= 0 {
+		return nil
+	}
+
+	var c uint64
+	if w.clock != nil {
+		c = w.clock()
+	} else {
+		c = w.next.Load()
+	}
+
+	t := w.tab.Load()
+	p := w.pending.Load()
+	if p != nil && p.base != t {
+		p = nil
+	}
+
+	v := make([]T, n)
+	for i := range v {
+		pos := c + uint64(i)
+		if p != nil && pos >= p.at {
+			t = p.tab
+		}
+		v[i] = t.slots[t.at(pos)]
+	}
+	return v
+}
+
+// Reset moves the cursor back to the start of the cycle, so the next
+// Next() returns the first item of the cycle; e.g., to replay a
+// sequence deterministically. Selections racing with Reset() are
+// ordered either before or after it: afterwards the cursor is at the
+// number of selections made since the reset. Stats are not cleared.
+func (w *WRR[T]) Reset() {
+	w.next.Store(0)
+}
+
+// Position returns the raw value of the cursor: the number of
+// positions reserved so far, less any rewinds (see Next()). Save it
+// with SetPosition() to resume the sequence, e.g., across restarts.
+func (w *WRR[T]) Position() uint64 {
+	return w.next.Load()
+}
+
+// SetPosition restores a cursor value returned by Position(). The
+// raw value is stored; Next() reduces it modulo the cycle length, so
+// any value resumes at a well-defined point of the cycle, including
+// mid-cycle.
+func (w *WRR[T]) SetPosition(pos uint64) {
+	w.next.Store(pos)
+}
+
+// pick makes the selection for Next() and returns the table and
+// slot index
+func (w *WRR[T]) pick() (*table[T], int) {
+	var t *table[T]
+	var c uint64
+	if w.shards != nil {
+		t, c = w.advanceShard()
+	} else {
+		t, c = w.advance(1)
+	}
+
+	j := t.at(c)
+	if l := w.anti.Load(); l != nil {
+		j = l.avoid(w, t, j)
+	}
+	if w.track.Load() {
+		w.last.Store(int64(j))
+	}
+	t.count(j)
+	return t, j
+}
+
+// Returns the next item in the smooth weighted sequence along with
+// its index in the original input order and its position in the
+// cycle, from 0 to the cycle length - 1. This is meant for verbose
+// logging of individual selections; Next() is leaner.
+func (w *WRR[T]) NextWithPosition() (T, int, int) {
+	t, c := w.advance(1)
+	p := c % uint64(t.size())
+	j := t.at(p)
+	t.count(j)
+	return t.slots[j], w.ext(j), int(p)
+}
+
+// Returns the next item in the smooth weighted sequence and true if
+// the selection was at the first position of a cycle, i.e., a new
+// cycle just started; this lets callers act at cycle boundaries
+// without keeping count.
+func (w *WRR[T]) NextWithWrap() (T, bool) {
+	t, c := w.advance(1)
+	j := t.at(c)
+	t.count(j)
+	return t.slots[j], c%uint64(t.size()) == 0
+}
+
+// fits returns an error unless every index of n slots fits in I.
+// Callers validate the slot count but a wider index must never
+// truncate silently.
+func fits[I index](n int) error {
+	if uint64(n-1) > uint64(^I(0)) {
+		return fmt.Errorf("wrr: slot index %d doesn't fit in a %d-bit table",
+			n-1, bits.Len64(uint64(^I(0))))
+	}
+	return nil
+}
+
+// compile runs the smooth weighted round-robin over the (normalized)
+// weights 'eff' and returns the resulting lookup table of 'tot'
+// entries. 'cur' is scratch space of len(eff) and must be zeroed.
+func compile[I index](eff, cur []int, tot int) ([]I, error) {
+	if err := fits[I](len(eff)); err != nil {
+		return nil, err
+	}
 
 	// hold short indices instead of 'T'
-	seq := make([]uint16, tot)
+	seq := make([]I, tot)
+
+	// plain round-robin: the smooth sequence is the identity; skip
+	// the O(n^2) loop below for large, uniform schedules.
+	if uniform(eff, tot) {
+		for i := range seq {
+			seq[i] = I(i)
+		}
+		return seq, nil
+	}
 
 	// now populate the fast lookup table
 	for i := range seq {
@@ -131,25 +904,338 @@ func New[T Weighted](slots []T) (*WRR[T], error) {
 				best = j
 			}
 		}
-		seq[i] = uint16(best)
+		seq[i] = I(best)
 		cur[best] -= tot
 	}
+	return seq, nil
+}
 
-	w := &WRR[T]{
-		slots: make([]T, n),
-		seq:   seq,
+// uniform returns true if every one of the weights 'eff' summing to
+// 'tot' is 1.
+func uniform(eff []int, tot int) bool {
+	return tot == len(eff) && !slices.Contains(eff, 0)
+}
+
+// compileLRU is compile() with ties between equal credits broken in
+// favor of the slot selected longest ago rather than the lowest
+// index; slots not yet selected are the oldest.
+func compileLRU[I index](eff, cur []int, tot int) ([]I, error) {
+	if uniform(eff, tot) {
+		// LRU order is the identity as well
+		return compile[I](eff, cur, tot)
 	}
 
-	copy(w.slots, slots)
-	return w, nil
+	last := make([]int, len(eff))
+	for j := range last {
+		last[j] = -1
+	}
+
+	if err := fits[I](len(eff)); err != nil {
+		return nil, err
+	}
+
+	seq := make([]I, tot)
+	for i := range seq {
+		var best int
+		for j := range eff {
+			cur[j] += eff[j]
+			if cur[j] > cur[best] || (cur[j] == cur[best] && last[j] < last[best]) {
+				best = j
+			}
+		}
+		seq[i] = I(best)
+		last[best] = i
+		cur[best] -= tot
+	}
+	return seq, nil
 }
 
-// Returns the next item in the smooth weighted sequence.
-// Cycles deterministically in O(1) and is concurrency-safe.
-func (w *WRR[T]) Next() T {
-	i := (w.next.Add(1) - 1) % uint64(len(w.seq))
-	j := w.seq[i]
-	return w.slots[j]
+// compileAverages orders the table by the highest averages method
+// 'm': each position goes to the slot with the largest eff[j]/d(s),
+// where s is the number of positions it already holds. 'cur' is
+// scratch space of len(eff) and must be zeroed.
+func compileAverages[I index](eff, cur []int, tot int, m Apportionment) ([]I, error) {
+	if err := fits[I](len(eff)); err != nil {
+		return nil, err
+	}
+
+	var div func(s int) int
+	switch m {
+	case Webster:
+		div = func(s int) int { return 2*s + 1 }
+	case DHondt:
+		div = func(s int) int { return s + 1 }
+	default:
+		return nil, fmt.Errorf("wrr: unknown apportionment %d", m)
+	}
+
+	// cur[j] is the number of seats held by slot j
+	seq := make([]I, tot)
+	for i := range seq {
+		best := -1
+		for j := range eff {
+			if cur[j] == eff[j] {
+				continue
+			}
+
+			// eff[j]/div(cur[j]) > eff[best]/div(cur[best])
+			if best < 0 || eff[j]*div(cur[best]) > eff[best]*div(cur[j]) {
+				best = j
+			}
+		}
+		seq[i] = I(best)
+		cur[best]++
+	}
+	return seq, nil
+}
+
+// NextIndicesInto fills 'buf' with the indices (in the original
+// input order) of the next len(buf) items in the smooth weighted
+// sequence and returns the number filled. The positions are reserved
+// with a single cursor update, so concurrent callers each get a
+// contiguous run of the sequence. It doesn't allocate.
+func (w *WRR[T]) NextIndicesInto(buf []int) int {
+	if len(buf) == 0 {
+		return 0
+	}
+
+	t, c := w.advance(uint64(len(buf)))
+	for i := range buf {
+		j := t.at(c + uint64(i))
+		t.count(j)
+		buf[i] = w.ext(j)
+	}
+	return len(buf)
+}
+
+// NextN returns the next 'n' items in the smooth weighted sequence
+// in a newly allocated slice. The positions are reserved with a
+// single cursor update, so concurrent callers each get a contiguous
+// run of the sequence, which may span the end of the cycle. Returns
+// nil if n <= 0.
+func (w *WRR[T]) NextN(n int) []T {
+	if n <= 0 {
+		return nil
+	}
+
+	v := make([]T, n)
+	t, c := w.advance(uint64(n))
+	for i := range v {
+		j := t.at(c + uint64(i))
+		t.count(j)
+		v[i] = t.slots[j]
+	}
+	return v
+}
+
+// Iter returns an iterator over the next 'n' items in the smooth
+// weighted sequence, e.g.:
+//
+//	for v := range sched.Iter(1000) {
+//		...
+//	}
+//
+// Each item is selected with Next() as the loop reaches it, so
+// breaking out of the loop early leaves the remaining positions for
+// other callers. Nothing is yielded if n <= 0.
+func (w *WRR[T]) Iter(n int) iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for range n {
+			if !yield(w.Next()) {
+				return
+			}
+		}
+	}
+}
+
+// IterInf returns an iterator over the smooth weighted sequence that
+// never ends on its own; the caller stops it with break. Like Iter()
+// each item is selected with Next() as the loop reaches it.
+func (w *WRR[T]) IterInf() iter.Seq[T] {
+	return func(yield func(T) bool) {
+		for yield(w.Next()) {
+		}
+	}
+}
+
+// advance reserves the next k positions of the cursor and returns
+// the table to select from and the first reserved position. Every
+// selection that moves the shared cursor goes through here. A
+// clocked scheduler reads the position from its clock instead.
+func (w *WRR[T]) advance(k uint64) (*table[T], uint64) {
+	var c uint64
+	if w.clock != nil {
+		c = w.clock()
+	} else {
+		c = w.next.Add(k) - k
+		if c >= wrapAt {
+			rewind(&w.next, w.tab.Load().size())
+		}
+	}
+	if p := w.pending.Load(); p != nil && c+k > p.at {
+		w.applyPending(p)
+	}
+	if r := w.ramp.Load(); r != nil {
+		w.stepRamp(r, k)
+	}
+	return w.tab.Load(), c
+}
+
+// advanceShard reserves the next position of a randomly chosen
+// shard cursor and returns the table to select from and the
+// position. Pending weight changes aren't applied: they count
+// positions of the shared cursor. Ramps count selections, so they
+// step here too.
+func (w *WRR[T]) advanceShard() (*table[T], uint64) {
+	if r := w.ramp.Load(); r != nil {
+		w.stepRamp(r, 1)
+	}
+
+	s := &w.shards[rand.IntN(len(w.shards))]
+	t := w.tab.Load()
+	c := s.Add(1) - 1
+	if c >= wrapAt {
+		rewind(&s.Uint64, t.size())
+	}
+	return t, c
+}
+
+// wrapAt is the cursor position past which a cursor is rewound
+const wrapAt = 1 << 63
+
+// rewind moves the cursor 'c' back by a multiple of the cycle length
+// 'n' once it passes wrapAt, long before the counter could overflow:
+// an overflow from 2^64-1 to 0 would jump within the cycle unless n
+// divides 2^64. The position within the cycle is unchanged so the
+// sequence continues seamlessly; selections racing with the rewind
+// hold positions nowhere near overflow and are unaffected.
+func rewind(c *atomic.Uint64, n int) {
+	l := wrapAt - wrapAt%uint64(n)
+	for {
+		v := c.Load()
+		if v < wrapAt || c.CompareAndSwap(v, v-l) {
+			return
+		}
+	}
+}
+
+// ext maps the slot index j to the index reported to callers
+func (w *WRR[T]) ext(j int) int {
+	if w.opt.sentinel {
+		return j + 1
+	}
+	return j
+}
+
+// internal maps an index reported to callers, see ext(), back to
+// the slot index
+func (w *WRR[T]) internal(j int) int {
+	if w.opt.sentinel {
+		return j - 1
+	}
+	return j
+}
+
+// none is the index reported to callers when no slot is selected
+func (w *WRR[T]) none() int {
+	if w.opt.sentinel {
+		return 0
+	}
+	return -1
+}
+
+// Warm reads the entire compiled table so that it is pulled into
+// the CPU cache, e.g., after an idle period, making the latency of
+// the next selections more predictable. It doesn't move the cursor.
+func (w *WRR[T]) Warm() {
+	t := w.tab.Load()
+
+	var sum uint64
+	for _, j := range t.narrow {
+		sum += uint64(j)
+	}
+	for _, j := range t.seq {
+		sum += uint64(j)
+	}
+	for _, j := range t.wide {
+		sum += uint64(j)
+	}
+
+	// keep the compiler from discarding the loads
+	warmSink.Store(sum)
+}
+
+var warmSink atomic.Uint64
+
+// IsUniform returns true if every enabled slot has the same
+// effective weight, i.e., the schedule is plain round-robin over
+// them. Slots of weight 0 are ignored.
+func (w *WRR[T]) IsUniform() bool {
+	var e int
+	for _, z := range w.tab.Load().eff {
+		switch {
+		case z == 0:
+		case e == 0:
+			e = z
+		case z != e:
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of slots
+func (w *WRR[T]) Len() int {
+	return len(w.tab.Load().slots)
+}
+
+// TotalWeight returns the sum of the weights after reduction by
+// their gcd, i.e., the length of one cycle; this is not the sum of
+// the configured weights: {100, 200} has a total weight of 3.
+func (w *WRR[T]) TotalWeight() int {
+	return w.tab.Load().size()
+}
+
+// GCD returns the greatest common divisor of the configured weights;
+// the weights are reduced by it when compiled, so the cycle is
+// TotalWeight() = sum(Weights())/GCD() selections long. A scheduler
+// adopting a sequence with NewFromSequence() is the exception: its
+// cycle is the length of the sequence.
+func (w *WRR[T]) GCD() int {
+	var g int
+	for _, v := range w.tab.Load().wts {
+		g = gcd(g, v)
+	}
+	return g
+}
+
+// Weights returns a copy of the configured weights in the original
+// input order. Weights and the compiled schedule are published
+// together as one immutable table, so the result is always the set
+// of weights the current schedule was compiled from, even while the
+// scheduler is being reconfigured.
+func (w *WRR[T]) Weights() []int {
+	t := w.tab.Load()
+	return append([]int(nil), t.wts...)
+}
+
+// EffectiveWeights returns a copy of the weights the current
+// schedule was compiled from after reduction by their gcd and any
+// WithMinRate() floors: slot i appears EffectiveWeights()[i] times
+// per cycle. Like Weights() it is taken from a single published
+// table; use WeightsSnapshot() to get both from the same one.
+func (w *WRR[T]) EffectiveWeights() []int {
+	t := w.tab.Load()
+	return append([]int(nil), t.eff...)
+}
+
+// WeightsSnapshot returns copies of the configured and the effective
+// weights, as Weights() and EffectiveWeights() do, taken from the same
+// published table; so the pair is consistent even when it races with
+// a reconfiguration, which separate calls to the two are not.
+func (w *WRR[T]) WeightsSnapshot() (configured, effective []int) {
+	t := w.tab.Load()
+	return append([]int(nil), t.wts...), append([]int(nil), t.eff...)
 }
 
 func gcd(a, b int) int {
@@ -15,6 +15,12 @@ package wrr
 
 import (
 	"fmt"
+	"math"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 )
 
@@ -338,8 +344,8 @@ func TestExactProportionsPerCycleNormalized(t *testing.T) {
 	// 1. Verify Optimization:
 	// The internal sequence should be reduced by the GCD (10).
 	// If optimization failed, len would be 100.
-	if len(w.seq) != 10 {
-		t.Fatalf("GCD optimization failed. Expected seq len 10, got %d", len(w.seq))
+	if n := w.tab.Load().size(); n != 10 {
+		t.Fatalf("GCD optimization failed. Expected seq len 10, got %d", n)
 	}
 
 	// 2. Verify Distribution:
@@ -382,3 +388,1346 @@ func TestWraparound(t *testing.T) {
 			i, first[i], v.name)
 	}
 }
+
+// -----------------------------------------------------------
+// Precompiled sequences
+// -----------------------------------------------------------
+
+func TestNewFromSequence(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	// compiled on one node, distributed to another
+	seq, err := CompileSequence([]int{5, 3, 2})
+	assert(err == nil, "compile: %v", err)
+	assert(len(seq) == 10, "expected seq len 10, got %d", len(seq))
+
+	w1 := mustNew(slots)
+	w2, err := NewFromSequence(slots, seq)
+	assert(err == nil, "from seq: %v", err)
+	for i := 0; i < 500; i++ {
+		a := w1.Next()
+		b := w2.Next()
+		assert(a.name == b.name,
+			"diverged at step %d: %s vs %s", i, a.name, b.name)
+	}
+
+	_, err = NewFromSequence(slots, []uint16{0, 1, 3})
+	assert(err != nil, "expected error for out of range index")
+
+	// a slot missing from the sequence is disabled
+	w3, err := NewFromSequence(slots, []uint16{0, 1, 0})
+	assert(err == nil, "missing slot: %v", err)
+	assert(w3.tab.Load().wts[2] == 0, "expected weight 0, got %d", w3.tab.Load().wts[2])
+
+	_, err = NewFromSequence(slots, nil)
+	assert(err != nil, "expected error for empty sequence")
+
+	// counts aren't reduced and compile options are ignored
+	w4, err := NewFromSequence(slots[:2], []uint16{0, 0, 1, 1}, WithIndexType(Uint32), WithStats())
+	assert(err == nil, "unreduced: %v", err)
+	assert(slices.Equal(w4.Weights(), []int{2, 2}), "expected weights {2,2}, got %v", w4.Weights())
+	assert(w4.GCD() == 2, "expected gcd 2, got %d", w4.GCD())
+	assert(w4.TotalWeight() == 4, "expected cycle of 4, got %d", w4.TotalWeight())
+	assert(w4.tab.Load().seq != nil, "expected the 16-bit sequence to be adopted")
+	w4.NextN(4)
+	assert(slices.Equal(w4.Stats(), []uint64{2, 2}), "expected stats {2,2}, got %v", w4.Stats())
+
+	_, err = CompileSequence([]int{1, -1})
+	assert(err != nil, "expected error for bad weight")
+}
+
+func TestCompileToArray(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 50),
+		wi("B", 0),
+		wi("C", 30),
+		wi("D", 20),
+	}
+
+	w, err := New(slots, WithIndexType(Uint32))
+	assert(err == nil, "new: %v", err)
+	w.NextN(3)
+
+	seq, wts, err := w.CompileToArray()
+	assert(err == nil, "export: %v", err)
+	assert(slices.Equal(wts, []int{5, 0, 3, 2}), "expected weights {5,0,3,2}, got %v", wts)
+
+	cnt := make([]int, len(slots))
+	for _, j := range seq {
+		cnt[j]++
+	}
+	assert(slices.Equal(cnt, wts), "counts %v don't match weights %v", cnt, wts)
+
+	// replaying the arrays selects like the scheduler
+	ref := mustNew(slots)
+	for i := range 3 * len(seq) {
+		x := ref.Next()
+		v := slots[seq[i%len(seq)]]
+		assert(v.name == x.name, "step %d: expected %s, got %s", i, x.name, v.name)
+	}
+
+	r, err := NewFromSequence(slots, seq)
+	assert(err == nil, "from seq: %v", err)
+	assert(names(r.Repeat(2)) == names(ref.Repeat(2)), "expected %s, got %s", names(ref.Repeat(2)), names(r.Repeat(2)))
+
+	// copies
+	seq[0], wts[0] = 3, 0
+	s2, w2, _ := w.CompileToArray()
+	assert(s2[0] == 0 && w2[0] == 5, "export aliased the table")
+
+	big := make([]wItem, 70000)
+	for i := range big {
+		big[i] = wi("x", 1)
+	}
+	w = mustNew(big)
+	_, _, err = w.CompileToArray()
+	assert(err != nil, "expected error for %d slots", len(big))
+}
+
+func TestIsUniform(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := mustNew([]wItem{wi("A", 2), wi("B", 2), wi("C", 2)})
+	assert(w.IsUniform(), "expected {2,2,2} to be uniform")
+
+	w = mustNew([]wItem{wi("A", 2), wi("B", 2), wi("C", 1)})
+	assert(!w.IsUniform(), "expected {2,2,1} to not be uniform")
+
+	w = mustNew([]wItem{wi("A", 7)})
+	assert(w.IsUniform(), "expected single slot to be uniform")
+
+	// disabled slots don't count
+	w = mustNew([]wItem{wi("A", 3), wi("B", 0), wi("C", 3)})
+	assert(w.IsUniform(), "expected {3,0,3} to be uniform")
+
+	// the floor evens out the effective weights
+	w, err := New([]wItem{wi("A", 3), wi("B", 1)}, WithMinRate(1, 2))
+	assert(err == nil, "new: %v", err)
+	assert(slices.Equal(w.EffectiveWeights(), []int{2, 2}), "unexpected effective weights %v", w.EffectiveWeights())
+	assert(w.IsUniform(), "expected {3,1} with a floor of 2 to be uniform")
+}
+
+func TestNewExponential(t *testing.T) {
+	assert := newAsserter(t)
+	items := []string{"A", "B", "C"}
+
+	w, err := NewExponential(items, []int{0, 1, 2}, 2)
+	assert(err == nil, "exponential: %v", err)
+	wts := w.tab.Load().wts
+	assert(wts[0] == 1 && wts[1] == 2 && wts[2] == 4,
+		"expected weights {1,2,4}, got %v", wts)
+
+	m := make(map[string]int)
+	for i := 0; i < 700; i++ {
+		m[w.Next()]++
+	}
+	assert(m["A"] == 100, "A: expected 100, got %d", m["A"])
+	assert(m["B"] == 200, "B: expected 200, got %d", m["B"])
+	assert(m["C"] == 400, "C: expected 400, got %d", m["C"])
+
+	_, err = NewExponential(items, []int{0, 1, 63}, 2)
+	assert(err != nil, "expected overflow error")
+
+	_, err = NewExponential(items, []int{0, 1, 30}, 2)
+	assert(err != nil, "expected table too large error")
+
+	_, err = NewExponential(items, []int{0, 1}, 2)
+	assert(err != nil, "expected level count mismatch error")
+}
+
+func TestNewFunc(t *testing.T) {
+	assert := newAsserter(t)
+
+	// no Weight() method
+	type backend struct {
+		addr string
+		cap  int
+	}
+	items := []backend{
+		{"10.0.0.1", 5},
+		{"10.0.0.2", 3},
+		{"10.0.0.3", 2},
+	}
+
+	w, err := NewFunc(items, func(b backend) int { return b.cap })
+	assert(err == nil, "func: %v", err)
+
+	m := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		m[w.Next().addr]++
+	}
+	assert(m["10.0.0.1"] == 500, "expected 500, got %d", m["10.0.0.1"])
+	assert(m["10.0.0.2"] == 300, "expected 300, got %d", m["10.0.0.2"])
+	assert(m["10.0.0.3"] == 200, "expected 200, got %d", m["10.0.0.3"])
+
+	// same schedule as New() for the same weights
+	ref := mustNew([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)})
+	assert(w.Signature() == ref.Signature(), "schedules differ")
+
+	// parallel slices
+	keys := []string{"x", "y"}
+	wts := map[string]int{"x": 1, "y": -1}
+	_, err = NewFunc(keys, func(s string) int { return wts[s] })
+	assert(err != nil, "expected bad weight error")
+}
+
+func TestNewExcluding(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 50),
+		wi("B", 40),
+		wi("C", 30),
+		wi("D", 20),
+	}
+
+	w, err := NewExcluding(slots, []int{1, 3, 1})
+	assert(err == nil, "new: %v", err)
+	assert(slices.Equal(w.Weights(), []int{50, 0, 30, 0}), "expected {50,0,30,0}, got %v", w.Weights())
+	assert(w.TotalWeight() == 8, "expected cycle of 8, got %d", w.TotalWeight())
+
+	m := tally(w, 800)
+	assert(m["B"] == 0 && m["D"] == 0, "denied slots selected: %v", m)
+	assert(m["A"] == 500 && m["C"] == 300, "expected A:C 500:300, got %v", m)
+
+	// indices are those of the catalog
+	for range 16 {
+		j := w.NextIndex()
+		assert(j == 0 || j == 2, "unexpected index %d", j)
+	}
+
+	w, err = NewExcluding(slots, nil)
+	assert(err == nil, "new: %v", err)
+	assert(w.Len() == 4 && w.TotalWeight() == 14, "empty deny list changed the scheduler")
+
+	_, err = NewExcluding(slots, []int{4})
+	assert(err != nil, "expected error for bad index")
+	_, err = NewExcluding(slots, []int{0, 1, 2, 3})
+	assert(err != nil, "expected error for denying every slot")
+}
+
+func TestNewFromMap(t *testing.T) {
+	assert := newAsserter(t)
+	m := map[string]int{
+		"10.0.0.3": 2,
+		"10.0.0.1": 5,
+		"10.0.0.2": 3,
+	}
+
+	w, err := NewFromMap(m)
+	assert(err == nil, "map: %v", err)
+
+	c := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		c[w.Next()]++
+	}
+	for k, v := range m {
+		assert(c[k] == v*100, "%s: expected %d, got %d", k, v*100, c[k])
+	}
+
+	// equal maps, filled in a different order, give the same schedule
+	for i := 0; i < 10; i++ {
+		o := make(map[string]int)
+		for _, k := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+			o[k] = m[k]
+		}
+		r, err := NewFromMap(o)
+		assert(err == nil, "map: %v", err)
+		assert(r.Signature() == w.Signature(), "run %d: schedules differ", i)
+		w.Reset()
+		for j := 0; j < 10; j++ {
+			x, y := w.Next(), r.Next()
+			assert(x == y, "run %d step %d: expected %s, got %s", i, j, x, y)
+		}
+	}
+
+	_, err = NewFromMap(map[string]int{})
+	assert(err != nil, "expected error for empty map")
+
+	_, err = NewFromMap(map[int]int{1: 1, 2: -1})
+	assert(err != nil, "expected bad weight error")
+}
+
+func TestNewMultiDim(t *testing.T) {
+	assert := newAsserter(t)
+
+	type node struct {
+		name string
+		cpu  int
+		mem  int
+	}
+	items := []node{
+		{"A", 4, 1},
+		{"B", 1, 4},
+		{"C", 1, 1},
+	}
+	cpu := func(n node) int { return n.cpu }
+	mem := func(n node) int { return n.mem }
+
+	// cpu counts twice: A=9, B=6, C=3 -> 3:2:1
+	w, err := NewMultiDim(items, []func(node) int{cpu, mem}, []int{2, 1})
+	assert(err == nil, "multidim: %v", err)
+	assert(slices.Equal(w.EffectiveWeights(), []int{3, 2, 1}),
+		"expected {3,2,1}, got %v", w.EffectiveWeights())
+
+	m := make(map[string]int)
+	for i := 0; i < 600; i++ {
+		m[w.Next().name]++
+	}
+	assert(m["A"] == 300 && m["B"] == 200 && m["C"] == 100, "expected 300/200/100, got %v", m)
+
+	// a zero dimension weight ignores that dimension
+	w, err = NewMultiDim(items, []func(node) int{cpu, mem}, []int{0, 1})
+	assert(err == nil, "multidim: %v", err)
+	assert(slices.Equal(w.Weights(), []int{1, 4, 1}), "expected {1,4,1}, got %v", w.Weights())
+
+	_, err = NewMultiDim(items, []func(node) int{cpu}, []int{1, 1})
+	assert(err != nil, "expected error for dimension count mismatch")
+
+	_, err = NewMultiDim(items, nil, nil)
+	assert(err != nil, "expected error for no dimensions")
+
+	_, err = NewMultiDim(items, []func(node) int{cpu}, []int{-1})
+	assert(err != nil, "expected error for negative dimension weight")
+
+	neg := func(n node) int { return -n.cpu }
+	_, err = NewMultiDim(items, []func(node) int{neg}, []int{1})
+	assert(err != nil, "expected error for negative weight")
+
+	huge := func(n node) int { return math.MaxInt / 2 }
+	_, err = NewMultiDim(items, []func(node) int{huge}, []int{3})
+	assert(err != nil, "expected overflow error")
+}
+
+func TestNewInt32(t *testing.T) {
+	assert := newAsserter(t)
+	items := []string{"A", "B", "C"}
+
+	w, err := NewInt32(items, []int32{5, 3, 2})
+	assert(err == nil, "int32: %v", err)
+
+	m := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		m[w.Next()]++
+	}
+	assert(m["A"] == 500, "A: expected 500, got %d", m["A"])
+	assert(m["B"] == 300, "B: expected 300, got %d", m["B"])
+	assert(m["C"] == 200, "C: expected 200, got %d", m["C"])
+
+	_, err = NewInt32(items, []int32{5, -3, 2})
+	assert(err != nil, "expected negative weight error")
+
+	_, err = NewInt32(items, []int32{0, 0, 0})
+	assert(err != nil, "expected all zero weights error")
+
+	_, err = NewInt32(items, []int32{5, 3})
+	assert(err != nil, "expected weight count mismatch error")
+}
+
+func TestNewPacked(t *testing.T) {
+	assert := newAsserter(t)
+	items := []string{"A", "B", "C"}
+
+	// 4-bit weights 5, 3, 2 and a zero pad nibble
+	w, err := NewPacked(items, []byte{0x53, 0x20}, 4)
+	assert(err == nil, "packed: %v", err)
+
+	m := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		m[w.Next()]++
+	}
+	assert(m["A"] == 500, "A: expected 500, got %d", m["A"])
+	assert(m["B"] == 300, "B: expected 300, got %d", m["B"])
+	assert(m["C"] == 200, "C: expected 200, got %d", m["C"])
+
+	// 3-bit weights 7, 1, 4 straddle byte boundaries: 111 001 10|0
+	w, err = NewPacked(items, []byte{0xe6, 0x00}, 3)
+	assert(err == nil, "packed: %v", err)
+	wts := w.tab.Load().wts
+	assert(wts[0] == 7 && wts[1] == 1 && wts[2] == 4, "expected {7,1,4}, got %v", wts)
+
+	_, err = NewPacked(items, []byte{0x53}, 4)
+	assert(err != nil, "expected short input error")
+
+	_, err = NewPacked(items, []byte{0x53, 0x20, 0x00}, 4)
+	assert(err != nil, "expected long input error")
+
+	_, err = NewPacked(items, []byte{0x53, 0x20}, 0)
+	assert(err != nil, "expected bad width error")
+
+	_, err = NewPacked(items, []byte{0x00, 0x00}, 4)
+	assert(err != nil, "expected all zero weights error")
+}
+
+func TestLRUTieBreak(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 6),
+		wi("B", 4),
+		wi("C", 1),
+		wi("D", 1),
+	}
+
+	w := mustNew(slots)
+	l, err := New(slots, WithLRUTieBreak())
+	assert(err == nil, "lru: %v", err)
+
+	// same proportions
+	m := tally(l, 1200)
+	assert(m["A"] == 600 && m["B"] == 400 && m["C"] == 100 && m["D"] == 100,
+		"lru: bad proportions %v", m)
+
+	// lowest index: A B A B A C D A B A B A; B waits 4 picks
+	// lru:          A B A C B A D A B A B A; B waits at most 3
+	wg := w.tab.Load().maxGaps(4)
+	lg := l.tab.Load().maxGaps(4)
+	assert(wg[1] == 4, "default: expected B gap 4, got %d", wg[1])
+	assert(lg[1] == 3, "lru: expected B gap 3, got %d", lg[1])
+	assert(lg[0] <= wg[0], "lru: A gap %d worse than %d", lg[0], wg[0])
+
+	// uniform weights are plain round-robin either way
+	l, err = New([]wItem{wi("A", 2), wi("B", 2), wi("C", 2)}, WithLRUTieBreak())
+	assert(err == nil, "lru: %v", err)
+	for i := 0; i < 9; i++ {
+		v := l.Next()
+		assert(v.name == string(rune('A'+i%3)), "step %d: got %s", i, v.name)
+	}
+}
+
+func TestDominanceCheck(t *testing.T) {
+	assert := newAsserter(t)
+
+	_, err := New([]wItem{wi("A", 99), wi("B", 1)}, WithDominanceCheck(0.9))
+	assert(err != nil, "expected {99,1} to fail the check")
+
+	w, err := New([]wItem{wi("A", 85), wi("B", 15)}, WithDominanceCheck(0.9))
+	assert(err == nil, "{85,15}: %v", err)
+
+	// reconfiguration is checked as well
+	err = w.PenalizeErrors([]int{0, 100}, 1)
+	assert(err != nil, "expected penalized weights to fail the check")
+
+	// floors count: the light slot is raised to 20 of 100
+	_, err = New([]wItem{wi("A", 99), wi("B", 1)}, WithDominanceCheck(0.9), WithMinRate(1, 20))
+	assert(err == nil, "floored: %v", err)
+
+	_, err = New([]wItem{wi("A", 1)}, WithDominanceCheck(1.5))
+	assert(err != nil, "expected bad threshold error")
+}
+
+func TestBuildBudget(t *testing.T) {
+	assert := newAsserter(t)
+
+	// 1M entries x 2 slots
+	slots := []wItem{wi("A", 1<<20-1), wi("B", 1)}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := New(slots, WithBuildBudget(1000))
+	runtime.ReadMemStats(&after)
+	assert(err != nil, "expected budget error")
+
+	// the 2MB table was never allocated
+	n := after.TotalAlloc - before.TotalAlloc
+	assert(n < 1<<20, "allocated %d bytes before failing", n)
+
+	w, err := New([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)}, WithBuildBudget(30))
+	assert(err == nil, "within budget: %v", err)
+
+	// later reconfiguration is held to the same budget
+	err = w.ScheduleWeightChange(100, []int{50, 30, 21})
+	assert(err != nil, "expected budget error on reconfiguration")
+
+	// uniform weights are cheap
+	u := make([]wItem, 100)
+	for i := range u {
+		u[i] = wi(fmt.Sprintf("s%d", i), 7)
+	}
+	_, err = New(u, WithBuildBudget(100))
+	assert(err == nil, "uniform: %v", err)
+
+	// weights 0, 1 and 2 sum to the slot count but aren't uniform
+	z := make([]wItem, 300)
+	for i := range z {
+		z[i] = wi(fmt.Sprintf("s%d", i), i%3)
+	}
+	_, err = New(z, WithBuildBudget(300))
+	assert(err != nil, "expected budget error for non-uniform weights summing to n")
+
+	w, err = New(z[:2], WithBuildBudget(6))
+	assert(err == nil, "new: %v", err)
+	assert(!w.CanAdd(2), "CanAdd: expected {0,1,2} to exceed a budget of 6")
+	assert(w.CanAdd(1), "CanAdd: expected {0,1,1} within a budget of 6")
+}
+
+func TestMaxSeqLen(t *testing.T) {
+	assert := newAsserter(t)
+
+	// coprime: the table is the full sum
+	slots := []wItem{wi("A", 999983), wi("B", 999979)}
+	_, err := New(slots)
+	assert(err != nil, "expected default limit to reject %d entries", 999983+999979)
+	assert(strings.Contains(err.Error(), "1999962"), "error lacks the total: %v", err)
+
+	w, err := New(slots, WithMaxSeqLen(1<<21))
+	assert(err == nil, "raised limit: %v", err)
+	assert(w.tab.Load().size() == 1999962, "expected 1999962 entries, got %d", w.tab.Load().size())
+
+	// accepted and rejected at a small limit; the gcd counts
+	_, err = New([]wItem{wi("A", 60), wi("B", 40)}, WithMaxSeqLen(5))
+	assert(err == nil, "{60,40} reduces to 5: %v", err)
+
+	_, err = New([]wItem{wi("A", 61), wi("B", 40)}, WithMaxSeqLen(100))
+	assert(err != nil, "expected {61,40} to exceed 100")
+
+	_, err = New([]wItem{wi("A", 1)}, WithMaxSeqLen(-1))
+	assert(err != nil, "expected bad limit error")
+}
+
+func TestApportionment(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	// hand computed seat order over one cycle of 10 seats
+	tests := []struct {
+		a    Apportionment
+		want string
+	}{
+		{Smooth, "ABCAABACBA"},
+		{Webster, "ABCAABACBA"},
+		{DHondt, "ABACABAABC"},
+	}
+
+	for _, tc := range tests {
+		w, err := New(slots, WithApportionment(tc.a))
+		assert(err == nil, "%d: %v", tc.a, err)
+
+		got := names(w.Repeat(1))
+		assert(got == tc.want, "%d: expected %s, got %s", tc.a, tc.want, got)
+	}
+
+	// 3 seats: D'Hondt gives A two, Sainte-Laguë one each
+	w, _ := New(slots, WithApportionment(DHondt))
+	m := tally(w, 3)
+	assert(m["A"] == 2 && m["B"] == 1 && m["C"] == 0, "dhondt 3 seats: %v", m)
+
+	w, _ = New(slots, WithApportionment(Webster))
+	m = tally(w, 3)
+	assert(m["A"] == 1 && m["B"] == 1 && m["C"] == 1, "webster 3 seats: %v", m)
+
+	// exact proportions per cycle for uneven weights
+	w, err := New([]wItem{wi("A", 7), wi("B", 4), wi("C", 1)}, WithApportionment(DHondt))
+	assert(err == nil, "%v", err)
+	m = tally(w, 120)
+	assert(m["A"] == 70 && m["B"] == 40 && m["C"] == 10, "dhondt cycles: %v", m)
+
+	_, err = New(slots, WithApportionment(Apportionment(9)))
+	assert(err != nil, "expected unknown apportionment error")
+}
+
+func TestMinRate(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("heavy", 100),
+		wi("light", 1),
+	}
+
+	w, err := New(slots, WithMinRate(1, 5))
+	assert(err == nil, "new: %v", err)
+
+	// cycle length is unchanged; light borrows 4 picks from heavy
+	for cycle := 0; cycle < 10; cycle++ {
+		m := tally(w, 101)
+		assert(m["light"] == 5, "cycle %d: light expected 5, got %d", cycle, m["light"])
+		assert(m["heavy"] == 96, "cycle %d: heavy expected 96, got %d", cycle, m["heavy"])
+	}
+
+	// floor that doesn't bind leaves the schedule alone
+	w, err = New(slots, WithMinRate(0, 10))
+	assert(err == nil, "new: %v", err)
+	m := tally(w, 101)
+	assert(m["light"] == 1, "light expected 1, got %d", m["light"])
+
+	_, err = New(slots, WithMinRate(1, 101))
+	assert(err != nil, "expected error for unsatisfiable floor")
+
+	_, err = New(slots, WithMinRate(2, 1))
+	assert(err != nil, "expected error for bad index")
+
+	// a disabled slot stays disabled
+	w, err = New([]wItem{wi("A", 0), wi("B", 3), wi("C", 2)}, WithMinRate(0, 1))
+	assert(err == nil, "new: %v", err)
+	assert(slices.Equal(w.EffectiveWeights(), []int{0, 3, 2}), "unexpected effective weights %v", w.EffectiveWeights())
+	m = tally(w, 50)
+	assert(m["A"] == 0, "disabled slot A selected %d times", m["A"])
+}
+
+func TestCompileIndexWidth(t *testing.T) {
+	assert := newAsserter(t)
+
+	// the last slot index doesn't fit in 16 bits; must not truncate
+	n := 65537
+	eff := make([]int, n)
+	cur := make([]int, n)
+	for i := range eff {
+		eff[i] = 1
+	}
+	seq, err := compile[uint16](eff, cur, n)
+	assert(err != nil, "expected error, got %d entries", len(seq))
+}
+
+func TestIndexType(t *testing.T) {
+	assert := newAsserter(t)
+
+	n := 70000
+	slots := make([]wItem, n)
+	for i := range slots {
+		slots[i] = wi(fmt.Sprintf("s%d", i), 1)
+	}
+
+	_, err := New(slots, WithIndexType(Uint16))
+	assert(err != nil, "expected error for %d slots with 16-bit indices", n)
+
+	w, err := New(slots, WithIndexType(Uint32))
+	assert(err == nil, "32-bit indices: %v", err)
+
+	// indices beyond 16 bits are not truncated
+	for i := 0; i < n; i++ {
+		v, j := w.NextTracked()
+		assert(j == i, "step %d: expected index %d, got %d", i, i, j)
+		assert(v.name == slots[i].name, "step %d: expected %s, got %s", i, slots[i].name, v.name)
+	}
+}
+
+func TestAutoIndexType(t *testing.T) {
+	assert := newAsserter(t)
+
+	n := 100000
+	slots := make([]wItem, n)
+	for i := range slots {
+		slots[i] = wi(fmt.Sprintf("s%d", i), 1)
+	}
+
+	w, err := New(slots)
+	assert(err == nil, "default index type: %v", err)
+	assert(w.tab.Load().wide != nil, "expected 32-bit indices for %d slots", n)
+
+	// one full cycle hits every slot exactly once
+	seen := make([]bool, n)
+	for i := 0; i < n; i++ {
+		_, j := w.NextTracked()
+		assert(!seen[j], "step %d: slot %d selected twice", i, j)
+		seen[j] = true
+	}
+
+	// smaller schedulers use narrower indices
+	w = mustNew(slots[:1000])
+	assert(w.tab.Load().seq != nil, "expected 16-bit indices for 1000 slots")
+	w = mustNew(slots[:256])
+	assert(w.tab.Load().narrow != nil, "expected 8-bit indices for 256 slots")
+	w = mustNew(slots[:257])
+	assert(w.tab.Load().seq != nil, "expected 16-bit indices for 257 slots")
+
+	_, err = New(slots[:257], WithIndexType(Uint8))
+	assert(err != nil, "expected error for 257 slots with 8-bit indices")
+}
+
+func TestNarrowIndexType(t *testing.T) {
+	assert := newAsserter(t)
+
+	n := 256
+	slots := make([]wItem, n)
+	for i := range slots {
+		slots[i] = wi(fmt.Sprintf("s%d", i), i%7+1)
+	}
+
+	for _, opts := range [][]Option{nil, {WithLRUTieBreak()}, {WithApportionment(Webster)}} {
+		a, err := New(slots, append(opts, WithIndexType(Uint8))...)
+		assert(err == nil, "8-bit indices: %v", err)
+		b, err := New(slots, append(opts, WithIndexType(Uint16))...)
+		assert(err == nil, "16-bit indices: %v", err)
+		assert(a.tab.Load().narrow != nil, "expected 8-bit indices")
+		assert(a.TotalWeight() == b.TotalWeight(), "cycle lengths differ: %d vs %d", a.TotalWeight(), b.TotalWeight())
+
+		for i := range 2 * a.TotalWeight() {
+			x, j := a.NextTracked()
+			y, k := b.NextTracked()
+			assert(j == k && x == y, "step %d: 8-bit %d, 16-bit %d", i, j, k)
+		}
+
+		// sub-schedules keep the width
+		ready := make([]bool, n)
+		ready[3], ready[255] = true, true
+		for i := range 20 {
+			_, j, _ := a.NextReady(ready)
+			_, k, _ := b.NextReady(ready)
+			assert(j == k, "ready step %d: 8-bit %d, 16-bit %d", i, j, k)
+		}
+	}
+}
+
+func BenchmarkNextIndexWidth(b *testing.B) {
+	slots := make([]wItem, 200)
+	for i := range slots {
+		slots[i] = wi(fmt.Sprintf("s%d", i), 1000+i)
+	}
+
+	for _, it := range []struct {
+		name string
+		typ  IndexType
+	}{{"uint8", Uint8}, {"uint16", Uint16}, {"uint32", Uint32}} {
+		w, err := New(slots, WithIndexType(it.typ))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(it.name, func(b *testing.B) {
+			for b.Loop() {
+				w.Next()
+			}
+		})
+	}
+}
+
+func TestWarm(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w := mustNew(slots)
+	ref := mustNew(slots)
+	tally(w, 3)
+	tally(ref, 3)
+
+	w.Warm()
+	for i := 0; i < 20; i++ {
+		a := w.Next()
+		b := ref.Next()
+		assert(a.name == b.name, "step %d: Warm moved the cursor: %s vs %s", i, a.name, b.name)
+	}
+}
+
+func TestNextIndicesInto(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w := mustNew(slots)
+	ref := mustNew(slots)
+
+	// odd sized batches straddle the cycle boundary
+	buf := make([]int, 7)
+	for round := 0; round < 20; round++ {
+		n := w.NextIndicesInto(buf)
+		assert(n == len(buf), "expected %d, got %d", len(buf), n)
+		for i, j := range buf {
+			_, k := ref.NextTracked()
+			assert(j == k, "round %d pos %d: expected %d, got %d", round, i, k, j)
+		}
+	}
+
+	assert(w.NextIndicesInto(nil) == 0, "expected 0 for empty buffer")
+	_, k := ref.NextTracked()
+	_, j := w.NextTracked()
+	assert(j == k, "empty buffer moved the cursor")
+}
+
+func TestNextWithWrap(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	for i := 0; i < 100; i++ {
+		v, wrap := w.NextWithWrap()
+		assert(wrap == (i%10 == 0), "step %d: wrap %v", i, wrap)
+		if wrap {
+			assert(v.name == "A", "step %d: expected cycle start A, got %s", i, v.name)
+		}
+	}
+}
+
+func TestNewClocked(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	var now atomic.Uint64
+	w, err := NewClocked(slots, now.Load)
+	assert(err == nil, "clocked: %v", err)
+
+	ref := mustNew(slots)
+	want := ref.Repeat(2)
+
+	// selection follows the clock, not the call count
+	for _, tick := range []uint64{0, 1, 1, 1, 4, 9, 13, 19} {
+		now.Store(tick)
+		for k := 0; k < 3; k++ {
+			v := w.Next()
+			assert(v.name == want[tick%10].name, "tick %d: expected %s, got %s",
+				tick, want[tick%10].name, v.name)
+		}
+	}
+
+	_, err = NewClocked(slots, nil)
+	assert(err != nil, "expected nil clock error")
+}
+
+func TestNewWithInfo(t *testing.T) {
+	assert := newAsserter(t)
+
+	// coprime and large: the gcd can't help
+	_, bi, err := NewWithInfo([]wItem{wi("A", 1009), wi("B", 997), wi("C", 3)})
+	assert(err == nil, "info: %v", err)
+	assert(bi.RawSum == 2009, "raw sum: expected 2009, got %d", bi.RawSum)
+	assert(bi.GCD == 1, "gcd: expected 1, got %d", bi.GCD)
+	assert(bi.TableSize == 2009, "table size: expected 2009, got %d", bi.TableSize)
+	assert(bi.Quantizable, "expected quantization hint")
+
+	// reduced by the gcd
+	_, bi, err = NewWithInfo([]wItem{wi("A", 500), wi("B", 300), wi("C", 200)})
+	assert(err == nil, "info: %v", err)
+	assert(bi.RawSum == 1000 && bi.GCD == 100 && bi.TableSize == 10,
+		"expected {1000, 100, 10}, got %+v", bi)
+	assert(!bi.Quantizable, "unexpected quantization hint")
+
+	_, _, err = NewWithInfo([]wItem{wi("A", -1)})
+	assert(err != nil, "expected bad weight error")
+}
+
+func TestNextWithPosition(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+	w := mustNew(slots)
+	want := w.Repeat(1)
+
+	for i := 0; i < 35; i++ {
+		v, j, pos := w.NextWithPosition()
+		assert(pos == i%10, "step %d: expected position %d, got %d", i, i%10, pos)
+		assert(v.name == want[pos].name, "step %d: expected %s, got %s", i, want[pos].name, v.name)
+		assert(slots[j].name == v.name, "index %d doesn't match %s", j, v.name)
+	}
+}
+
+func TestCursorWrap(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	// 2^63 is not a multiple of 10; neither is 2^64
+	w := mustNew(slots)
+	want := w.Repeat(1)
+	start := uint64(wrapAt - 5)
+	w.next.Store(start)
+
+	for i := uint64(0); i < 30; i++ {
+		v := w.Next()
+		exp := want[(start+i)%10]
+		assert(v.name == exp.name, "step %d: expected %s, got %s", i, exp.name, v.name)
+	}
+	assert(w.next.Load() < wrapAt, "cursor not rewound: %d", w.next.Load())
+
+	// independent cursors too
+	w.NextFor(0)
+	c := w.cursor(0)
+	c.Store(start)
+	for i := uint64(0); i < 30; i++ {
+		v := w.NextFor(0)
+		exp := want[(start+i)%10]
+		assert(v.name == exp.name, "cursor 0 step %d: expected %s, got %s", i, exp.name, v.name)
+	}
+	assert(c.Load() < wrapAt, "cursor 0 not rewound: %d", c.Load())
+
+	// the proportions over a cycle straddling the rewind are exact
+	w.next.Store(wrapAt - 3)
+	m := tally(w, 10)
+	assert(m["A"] == 5 && m["B"] == 3 && m["C"] == 2, "straddling cycle: %v", m)
+}
+
+func TestPeek(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}, WithStats())
+	assert(err == nil, "new: %v", err)
+
+	for i := 0; i < 30; i++ {
+		p := w.Peek()
+		q := w.Peek()
+		assert(p.name == q.name, "step %d: peeks differ %s vs %s", i, p.name, q.name)
+
+		v := w.Next()
+		assert(v.name == p.name, "step %d: peeked %s, next %s", i, p.name, v.name)
+	}
+
+	var n uint64
+	for _, c := range w.Stats() {
+		n += c
+	}
+	assert(n == 30, "peek counted selections: %d", n)
+
+	// a change due at the current position is peeked too
+	at := w.next.Load()
+	err = w.ScheduleWeightChange(at, []int{1, 100, 1})
+	assert(err == nil, "schedule: %v", err)
+	p := w.Peek()
+	v := w.Next()
+	assert(p.name == v.name, "pending change: peeked %s, next %s", p.name, v.name)
+}
+
+func TestNextIndex(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, ref := mustNew(slots), mustNew(slots)
+	for i := 0; i < 35; i++ {
+		// interleave with Next() on the same cursor
+		if i%3 == 0 {
+			v, x := w.Next(), ref.Next()
+			assert(v.name == x.name, "step %d: expected %s, got %s", i, x.name, v.name)
+			continue
+		}
+
+		j, x := w.NextIndex(), ref.Next()
+		assert(slots[j].name == x.name, "step %d: expected %s, got index %d", i, x.name, j)
+	}
+	assert(w.Position() == 35, "expected position 35, got %d", w.Position())
+
+	w, err := New(slots, WithSentinelZero())
+	assert(err == nil, "new: %v", err)
+	j := w.NextIndex()
+	assert(j == 1, "sentinel: expected index 1, got %d", j)
+}
+
+func TestUpcoming(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}, WithStats())
+	assert(err == nil, "new: %v", err)
+	w.NextN(7)
+
+	v := w.Upcoming(13)
+	assert(len(v) == 13, "expected 13 items, got %d", len(v))
+	assert(w.Position() == 7, "cursor moved to %d", w.Position())
+	assert(slices.Equal(w.Stats(), []uint64{4, 2, 1}), "upcoming counted selections: %v", w.Stats())
+
+	for i, x := range v {
+		y := w.Next()
+		assert(x.name == y.name, "step %d: expected %s, got %s", i, y.name, x.name)
+	}
+
+	// a pending change takes effect at its position
+	err = w.ScheduleWeightChange(w.Position()+3, []int{0, 1, 0})
+	assert(err == nil, "schedule: %v", err)
+	v = w.Upcoming(6)
+	assert(names(v[3:]) == "BBB", "expected the change from position 3, got %s", names(v))
+	for i, x := range v {
+		y := w.Next()
+		assert(x.name == y.name, "pending step %d: expected %s, got %s", i, y.name, x.name)
+	}
+
+	assert(w.Upcoming(0) == nil, "expected nil for n=0")
+}
+
+func TestNextN(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, ref := mustNew(slots), mustNew(slots)
+
+	// batches straddle the cycle boundary
+	var got []wItem
+	for _, n := range []int{3, 64, 7, 1, 10, 13} {
+		v := w.NextN(n)
+		assert(len(v) == n, "expected %d items, got %d", n, len(v))
+		got = append(got, v...)
+	}
+	for i, v := range got {
+		x := ref.Next()
+		assert(v.name == x.name, "position %d: expected %s, got %s", i, x.name, v.name)
+	}
+
+	assert(w.NextN(0) == nil, "expected nil for n=0")
+	assert(w.NextN(-1) == nil, "expected nil for n<0")
+}
+
+func TestLenTotalWeight(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := mustNew([]wItem{wi("A", 100), wi("B", 200)})
+	assert(w.Len() == 2, "expected 2 slots, got %d", w.Len())
+	assert(w.TotalWeight() == 3, "expected total weight 3, got %d", w.TotalWeight())
+
+	w = mustNew([]wItem{wi("A", 5), wi("B", 3), wi("C", 2)})
+	assert(w.Len() == 3, "expected 3 slots, got %d", w.Len())
+	assert(w.TotalWeight() == 10, "expected total weight 10, got %d", w.TotalWeight())
+
+	n := testing.AllocsPerRun(100, func() {
+		_ = w.Len() + w.TotalWeight()
+	})
+	assert(n == 0, "expected no allocations, got %v", n)
+}
+
+func TestReset(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w := mustNew(slots)
+	for i := 0; i < 7; i++ {
+		w.Next()
+	}
+	w.Reset()
+
+	ref := mustNew(slots)
+	for i := 0; i < 25; i++ {
+		x, y := w.Next(), ref.Next()
+		assert(x.name == y.name, "step %d: expected %s, got %s", i, y.name, x.name)
+	}
+}
+
+func TestGCD(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := mustNew([]wItem{wi("A", 100), wi("B", 200), wi("C", 300)})
+	assert(w.GCD() == 100, "expected gcd 100, got %d", w.GCD())
+	assert(w.TotalWeight() == 600/w.GCD(), "expected total weight %d, got %d", 600/w.GCD(), w.TotalWeight())
+
+	w = mustNew([]wItem{wi("A", 5), wi("B", 3)})
+	assert(w.GCD() == 1, "expected gcd 1, got %d", w.GCD())
+}
+
+func TestWeights(t *testing.T) {
+	assert := newAsserter(t)
+
+	w := mustNew([]wItem{wi("A", 100), wi("B", 200), wi("C", 300)})
+	w.NextN(5)
+
+	wts, eff := w.Weights(), w.EffectiveWeights()
+	assert(slices.Equal(wts, []int{100, 200, 300}), "expected weights {100,200,300}, got %v", wts)
+	assert(slices.Equal(eff, []int{1, 2, 3}), "expected effective weights {1,2,3}, got %v", eff)
+	assert(w.TotalWeight() == 6, "expected total weight 6, got %d", w.TotalWeight())
+
+	// reading them doesn't change the scheduler
+	wts[0], eff[0] = 0, 0
+	assert(w.Weights()[0] == 100 && w.EffectiveWeights()[0] == 1, "caller copies alias the table")
+	assert(w.Position() == 5, "cursor moved to %d", w.Position())
+
+	// floors show in the effective weights only
+	w, err := New([]wItem{wi("A", 90), wi("B", 10)}, WithMinRate(1, 3))
+	assert(err == nil, "new: %v", err)
+	assert(slices.Equal(w.Weights(), []int{90, 10}), "expected weights {90,10}, got %v", w.Weights())
+	assert(slices.Equal(w.EffectiveWeights(), []int{7, 3}), "expected effective weights {7,3}, got %v", w.EffectiveWeights())
+}
+
+func TestPosition(t *testing.T) {
+	assert := newAsserter(t)
+	w := mustNew([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	})
+
+	for i := 0; i < 13; i++ {
+		w.Next()
+	}
+	pos := w.Position()
+	assert(pos == 13, "expected position 13, got %d", pos)
+
+	want := w.NextN(25)
+	w.SetPosition(pos)
+	for i, x := range want {
+		v := w.Next()
+		assert(v.name == x.name, "replay step %d: expected %s, got %s", i, x.name, v.name)
+	}
+
+	// a fresh scheduler resumes mid-cycle
+	r := mustNew(w.tab.Load().slots)
+	r.SetPosition(pos)
+	for i, x := range want {
+		v := r.Next()
+		assert(v.name == x.name, "restore step %d: expected %s, got %s", i, x.name, v.name)
+	}
+}
+
+func TestZeroWeight(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 0),
+		wi("B", 3),
+		wi("C", 1),
+	}
+
+	w, err := New(slots)
+	assert(err == nil, "new: %v", err)
+	assert(w.TotalWeight() == 4, "expected cycle of 4, got %d", w.TotalWeight())
+
+	m := tally(w, 400)
+	assert(m["A"] == 0, "A: expected 0, got %d", m["A"])
+	assert(m["B"] == 300, "B: expected 300, got %d", m["B"])
+	assert(m["C"] == 100, "C: expected 100, got %d", m["C"])
+
+	// the gcd ignores zeros
+	w, err = New([]wItem{wi("A", 6), wi("B", 0), wi("C", 4)})
+	assert(err == nil, "new: %v", err)
+	assert(w.TotalWeight() == 5, "expected cycle of 5, got %d", w.TotalWeight())
+	for _, v := range w.Repeat(1) {
+		assert(v.name != "B", "disabled slot B in the cycle")
+	}
+
+	// n slots summing to n aren't necessarily uniform
+	w, err = New([]wItem{wi("A", 0), wi("B", 2), wi("C", 1)})
+	assert(err == nil, "new: %v", err)
+	assert(names(w.Repeat(1)) == "BCB", "expected BCB, got %s", names(w.Repeat(1)))
+
+	// disabled slots stay disabled
+	err = w.PenalizeErrors([]int{5, 0, 0}, 1)
+	assert(err == nil, "penalize: %v", err)
+	assert(w.tab.Load().wts[0] == 0, "penalize revived slot A")
+
+	// ready sets without weight
+	_, j, ok := w.NextReady([]bool{true, false, false})
+	assert(!ok && j == -1, "expected no ready slot, got %d", j)
+
+	_, err = New([]wItem{wi("A", 0), wi("B", 0)})
+	assert(err != nil, "expected error for all zero weights")
+
+	_, err = New([]wItem{wi("A", -1), wi("B", 2)})
+	assert(err != nil, "expected error for negative weight")
+
+	s, err := NewStreaming(slots)
+	assert(err == nil, "streaming: %v", err)
+	for i := 0; i < 100; i++ {
+		v := s.Next()
+		assert(v.name != "A", "streaming: disabled slot A selected")
+	}
+}
+
+func TestIter(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, ref := mustNew(slots), mustNew(slots)
+	var n int
+	for v := range w.Iter(23) {
+		x := ref.Next()
+		assert(v.name == x.name, "step %d: expected %s, got %s", n, x.name, v.name)
+		n++
+	}
+	assert(n == 23, "expected 23 items, got %d", n)
+
+	// break stops without selecting further
+	n = 0
+	for range w.Iter(100) {
+		if n++; n == 4 {
+			break
+		}
+	}
+	assert(w.Position() == 27, "expected position 27, got %d", w.Position())
+
+	for range w.Iter(0) {
+		t.Fatalf("Iter(0) yielded an item")
+	}
+
+	ref.SetPosition(w.Position())
+	n = 0
+	for v := range w.IterInf() {
+		x := ref.Next()
+		assert(v.name == x.name, "inf step %d: expected %s, got %s", n, x.name, v.name)
+		if n++; n == 50 {
+			break
+		}
+	}
+	assert(w.Position() == 77, "expected position 77, got %d", w.Position())
+}
+
+func TestSharding(t *testing.T) {
+	assert := newAsserter(t)
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	w, err := New(slots, WithSharding(4), WithStats())
+	assert(err == nil, "new: %v", err)
+	assert(len(w.shards) == 4, "expected 4 shards, got %d", len(w.shards))
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				w.Next()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// each shard walked the cycle from its own phase
+	tab := w.tab.Load()
+	want := make([]uint64, len(slots))
+	var sel uint64
+	for i := range w.shards {
+		start := uint64(i * 10 / 4)
+		end := w.shards[i].Load()
+		sel += end - start
+		for c := start; c < end; c++ {
+			want[tab.at(c)]++
+		}
+	}
+	assert(sel == 8000, "expected 8000 selections, got %d", sel)
+	assert(slices.Equal(w.Stats(), want), "expected %v, got %v", want, w.Stats())
+	assert(w.Position() == 0, "shared cursor moved to %d", w.Position())
+
+	// at most a partial cycle per shard off the exact shares
+	for j, v := range want {
+		d := math.Abs(float64(v) - 8000*float64(slots[j].w)/10)
+		assert(d <= 4*10, "slot %d: %d selections, off by %v", j, v, d)
+	}
+
+	w, err = New(slots, WithSharding(1))
+	assert(err == nil, "new: %v", err)
+	assert(w.shards == nil, "expected no shards for n=1")
+}
+
+func BenchmarkNextParallel(b *testing.B) {
+	slots := []wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}
+
+	// at least 2 shards: WithSharding(1) is the shared cursor
+	for _, n := range []int{0, max(2, runtime.GOMAXPROCS(0))} {
+		w, err := New(slots, WithSharding(n))
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		b.Run(fmt.Sprintf("shards=%d", n), func(b *testing.B) {
+			b.SetParallelism(16)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w.Next()
+				}
+			})
+		})
+	}
+}
+
+func TestPowerOfTwoCycle(t *testing.T) {
+	assert := newAsserter(t)
+
+	// cycles of 1, 8 and 16 are masked; 10 isn't
+	for _, wts := range [][]int{{4}, {5, 3}, {9, 4, 2, 1}, {5, 3, 2}} {
+		sc, err := CompileSequence(wts)
+		assert(err == nil, "compile %v: %v", wts, err)
+
+		s := schedule{seq: sc}
+		n := uint64(len(sc))
+		for _, c := range []uint64{0, 1, n - 1, n, n + 3, 7 * n, wrapAt - 1, wrapAt + 5, math.MaxUint64} {
+			want := int(sc[c%n])
+			assert(s.at(c) == want, "%v: pos %d: expected %d, got %d", wts, c, want, s.at(c))
+		}
+	}
+}
+
+func BenchmarkNextCycleLength(b *testing.B) {
+	for _, wts := range [][]int{{5, 3}, {5, 2}, {9, 4, 2, 1}, {9, 4, 2}} {
+		slots := make([]wItem, len(wts))
+		for i, v := range wts {
+			slots[i] = wi(fmt.Sprintf("s%d", i), v)
+		}
+		w := mustNew(slots)
+
+		b.Run(fmt.Sprintf("cycle=%d", w.TotalWeight()), func(b *testing.B) {
+			for b.Loop() {
+				w.Next()
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	assert := newAsserter(t)
+	w, err := New([]wItem{
+		wi("A", 5),
+		wi("B", 3),
+		wi("C", 2),
+	}, WithStats(), WithHistory(4))
+	assert(err == nil, "new: %v", err)
+	w.NextN(7)
+
+	c := w.Clone()
+	assert(c.Position() == 0, "clone cursor at %d", c.Position())
+	assert(slices.Equal(c.Stats(), []uint64{0, 0, 0}), "clone inherited stats %v", c.Stats())
+	assert(len(c.History()) == 0, "clone inherited history %v", c.History())
+	assert(names(c.Repeat(2)) == names(w.Repeat(2)), "clone sequence differs")
+
+	// independent cursors and counters
+	x := c.NextN(12)
+	assert(w.Position() == 7, "clone moved the original to %d", w.Position())
+	assert(names(x) == names(w.Repeat(2)[:12]), "clone didn't start the cycle: %s", names(x))
+	assert(slices.Equal(w.Stats(), []uint64{4, 2, 1}), "clone counted on the original: %v", w.Stats())
+
+	// copying the position continues where the original is
+	c.SetPosition(w.Position())
+	assert(names(c.NextN(9)) == names(w.NextN(9)), "clone diverged from the copied position")
+
+	// reconfiguring one leaves the other alone
+	err = c.UpdateWeights([]int{1, 1, 1})
+	assert(err == nil, "update: %v", err)
+	assert(slices.Equal(w.Weights(), []int{5, 3, 2}), "clone update changed the original: %v", w.Weights())
+	err = w.Remove(0)
+	assert(err == nil, "remove: %v", err)
+	assert(c.Len() == 3, "original remove changed the clone")
+}